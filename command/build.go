@@ -0,0 +1,223 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/remram44/drone-runner-qemu/engine"
+	"github.com/remram44/drone-runner-qemu/engine/compiler"
+	"github.com/remram44/drone-runner-qemu/engine/linter"
+	"github.com/remram44/drone-runner-qemu/engine/resource"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/runner-go/environ/provider"
+	"github.com/drone/runner-go/manifest"
+	"github.com/drone/runner-go/pipeline/runtime"
+	"github.com/drone/runner-go/secret"
+	"github.com/drone/signal"
+
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Where the provisioning script is uploaded in the machine
+const provisionScript = "/tmp/drone-provision"
+
+type buildCommand struct {
+	ImageDir *string
+	TempDir  string
+	Base     string
+	Name     string
+	Script   string
+	Source   string
+	Pipeline string
+	CPUs     int
+	Memory   string
+	DiskSize string
+	Debug    bool
+}
+
+// scriptSpec returns a spec running a shell script.
+func (c *buildCommand) scriptSpec() (*engine.Spec, error) {
+	script, err := ioutil.ReadFile(c.Script)
+	if err != nil {
+		return nil, err
+	}
+	return &engine.Spec{
+		Steps: []*engine.Step{
+			{
+				Name:    "provision",
+				Command: "/bin/sh",
+				Args:    []string{"-e", provisionScript},
+				Files: []*engine.File{
+					{
+						Path: provisionScript,
+						Mode: 0700,
+						Data: script,
+					},
+				},
+				WorkingDir: "/tmp",
+			},
+		},
+	}, nil
+}
+
+// pipelineSpec returns a spec running the steps of a pipeline.
+func (c *buildCommand) pipelineSpec() (*engine.Spec, error) {
+	manifest, err := manifest.ParseFile(c.Source)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Lookup(c.Pipeline, manifest)
+	if err != nil {
+		return nil, err
+	}
+	repo := &drone.Repo{Trusted: true}
+	if err := linter.New().Lint(res, repo); err != nil {
+		return nil, err
+	}
+
+	// There is no repository to clone
+	res.(*resource.Pipeline).Clone.Disable = true
+
+	comp := &compiler.Compiler{
+		Environ: provider.Static(nil),
+		Secret:  secret.StaticVars(nil),
+	}
+	args := runtime.CompilerArgs{
+		Pipeline: res,
+		Manifest: manifest,
+		Build:    &drone.Build{},
+		Netrc:    &drone.Netrc{},
+		Repo:     repo,
+		Stage:    &drone.Stage{},
+		System:   &drone.System{},
+	}
+	return comp.Compile(nocontext, args).(*engine.Spec), nil
+}
+
+func (c *buildCommand) run(*kingpin.ParseContext) error {
+	logrus.SetLevel(logrus.InfoLevel)
+	if c.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	var spec *engine.Spec
+	var err error
+	switch {
+	case c.Script != "" && c.Source != "":
+		return errors.New("use either --script or --source")
+	case c.Script != "":
+		spec, err = c.scriptSpec()
+	case c.Source != "":
+		spec, err = c.pipelineSpec()
+	default:
+		return errors.New("either --script or --source is required")
+	}
+	if err != nil {
+		return err
+	}
+	spec.Settings.Image = c.Base
+	if c.CPUs > 0 {
+		spec.Settings.CPUs = c.CPUs
+	}
+	if c.Memory != "" {
+		spec.Settings.Memory, err = units.RAMInBytes(c.Memory)
+		if err != nil {
+			return fmt.Errorf("invalid memory: %w", err)
+		}
+	}
+	if c.DiskSize != "" {
+		spec.Settings.DiskSize, err = units.RAMInBytes(c.DiskSize)
+		if err != nil {
+			return fmt.Errorf("invalid disk size: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(nocontext)
+	defer cancel()
+	ctx = signal.WithContextFunc(ctx, func() {
+		println("received signal, terminating process")
+		cancel()
+	})
+
+	eng, err := engine.New(engine.Opts{
+		ImageDir: *c.ImageDir,
+		TempDir:  c.TempDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Setup might have started machines before failing
+	defer eng.Destroy(nocontext, spec)
+	if err := eng.Setup(ctx, spec); err != nil {
+		return err
+	}
+
+	// Run the steps in order, stopping at the first failure
+	for _, step := range spec.Steps {
+		if step.RunPolicy == runtime.RunNever {
+			continue
+		}
+		fmt.Printf("+ %s\n", step.Name)
+		state, err := eng.Run(ctx, spec, step, os.Stdout)
+		if err != nil {
+			return err
+		}
+		if state.ExitCode != 0 && step.ErrPolicy != runtime.ErrIgnore {
+			return fmt.Errorf("step %s failed with exit status %d", step.Name, state.ExitCode)
+		}
+	}
+
+	return eng.Export(ctx, spec, c.Name)
+}
+
+func registerBuild(cmd *kingpin.CmdClause, imageDir *string) {
+	c := &buildCommand{ImageDir: imageDir}
+
+	build := cmd.Command("build", "build an image by provisioning another").
+		Action(c.run)
+
+	build.Arg("name", "name of the new image").
+		Required().
+		StringVar(&c.Name)
+
+	build.Flag("temp-dir", "temporary directory where files and images will be created").
+		Envar("DRONE_QEMU_TEMP_DIR").
+		StringVar(&c.TempDir)
+
+	build.Flag("base", "image to start from").
+		Required().
+		StringVar(&c.Base)
+
+	build.Flag("script", "shell script provisioning the machine").
+		StringVar(&c.Script)
+
+	build.Flag("source", "yaml file with a pipeline provisioning the machine").
+		StringVar(&c.Source)
+
+	build.Flag("pipeline", "name of the pipeline in the yaml file").
+		Default("default").
+		StringVar(&c.Pipeline)
+
+	build.Flag("cpus", "number of cpus of the machine").
+		IntVar(&c.CPUs)
+
+	build.Flag("memory", "memory of the machine, such as 4GiB").
+		StringVar(&c.Memory)
+
+	build.Flag("disk-size", "size of the disk, such as 20GiB").
+		StringVar(&c.DiskSize)
+
+	build.Flag("debug", "enable debug logging").
+		BoolVar(&c.Debug)
+}
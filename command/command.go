@@ -25,6 +25,7 @@ func Command() {
 	app := kingpin.New("drone", "drone qemu runner")
 	registerCompile(app)
 	registerExec(app)
+	registerImages(app)
 	daemon.Register(app)
 
 	kingpin.Version(version)
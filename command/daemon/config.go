@@ -7,7 +7,9 @@ package daemon
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/docker/go-units"
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
 )
@@ -61,6 +63,31 @@ type Config struct {
 		ImageDir	 string `envconfig:"DRONE_QEMU_IMAGE_DIR"`
 		TempDir		 string `envconfig:"DRONE_QEMU_TEMP_DIR"`
 		DefaultImage string `envconfig:"DRONE_QEMU_DEFAULT_IMAGE"`
+		MaxCPUs      int      `envconfig:"DRONE_QEMU_MAX_CPUS"`
+		MaxMemory    byteSize `envconfig:"DRONE_QEMU_MAX_MEMORY"`
+		MaxDiskSize  byteSize `envconfig:"DRONE_QEMU_MAX_DISK_SIZE"`
+
+		HostMemory       byteSize `envconfig:"DRONE_QEMU_HOST_MEMORY"`
+		HostCPUs         int      `envconfig:"DRONE_QEMU_HOST_CPUS"`
+		MemoryOvercommit float64  `envconfig:"DRONE_QEMU_MEMORY_OVERCOMMIT" default:"1"`
+		CPUOvercommit    float64  `envconfig:"DRONE_QEMU_CPU_OVERCOMMIT" default:"1"`
+
+		ImageManifest string `envconfig:"DRONE_QEMU_IMAGE_MANIFEST"`
+		SyncImages    bool   `envconfig:"DRONE_QEMU_SYNC_IMAGES"`
+
+		StateDir        string        `envconfig:"DRONE_QEMU_STATE_DIR"`
+		JanitorInterval time.Duration `envconfig:"DRONE_QEMU_JANITOR_INTERVAL" default:"5m"`
+
+		Network          string   `envconfig:"DRONE_QEMU_NETWORK" default:"full"`
+		NetworkEndpoints []string `envconfig:"DRONE_QEMU_NETWORK_ENDPOINTS"`
+
+		DebugTimeout time.Duration `envconfig:"DRONE_QEMU_DEBUG_TIMEOUT" default:"30m"`
+		DebugBind    string        `envconfig:"DRONE_QEMU_DEBUG_BIND" default:"127.0.0.1"`
+		DebugHost    string        `envconfig:"DRONE_QEMU_DEBUG_HOST"`
+
+		AllowTCG       bool          `envconfig:"DRONE_QEMU_ALLOW_TCG"`
+		HealthInterval time.Duration `envconfig:"DRONE_QEMU_HEALTH_INTERVAL" default:"1m"`
+		HealthRetry    time.Duration `envconfig:"DRONE_QEMU_HEALTH_RETRY" default:"10s"`
 	}
 
 	Environ struct {
@@ -82,6 +109,20 @@ type Config struct {
 	}
 }
 
+// byteSize is a size in bytes, which can be written with a unit
+// such as "4GiB".
+type byteSize int64
+
+// Decode implements envconfig.Decoder.
+func (b *byteSize) Decode(value string) error {
+	size, err := units.RAMInBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
 // legacy environment variables. the key is the legacy
 // variable name, and the value is the new variable name.
 var legacy = map[string]string{
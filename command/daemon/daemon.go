@@ -22,7 +22,6 @@ import (
 	"github.com/drone/runner-go/pipeline/reporter/history"
 	"github.com/drone/runner-go/pipeline/reporter/remote"
 	"github.com/drone/runner-go/pipeline/runtime"
-	"github.com/drone/runner-go/poller"
 	"github.com/drone/runner-go/secret"
 	"github.com/drone/runner-go/server"
 	"github.com/drone/signal"
@@ -79,30 +78,83 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 		),
 	)
 
+	// The network policy applies to pipelines that don't set one
+	if !engine.ValidNetworkPolicy(config.Settings.Network) {
+		logrus.WithField("network", config.Settings.Network).
+			Fatalln("invalid network policy")
+	}
+	var endpoints []engine.Endpoint
+	for _, value := range config.Settings.NetworkEndpoints {
+		endpoint, err := engine.ParseEndpoint(value)
+		if err != nil {
+			logrus.WithError(err).
+				Fatalln("invalid network endpoint")
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
 	opts := engine.Opts{
 		ImageDir: config.Settings.ImageDir,
 		TempDir: config.Settings.TempDir,
+		StateDir: config.Settings.StateDir,
+		Memory: int64(config.Settings.HostMemory),
+		CPUs: config.Settings.HostCPUs,
+		MemoryOvercommit: config.Settings.MemoryOvercommit,
+		CPUOvercommit: config.Settings.CPUOvercommit,
+		AllowTCG: config.Settings.AllowTCG,
+		Endpoints: endpoints,
+		DebugTimeout: config.Settings.DebugTimeout,
+		DebugBind: config.Settings.DebugBind,
+		DebugHost: config.Settings.DebugHost,
 	}
+	// Download the images before checking for them
+	if config.Settings.SyncImages {
+		if config.Settings.ImageManifest == "" {
+			logrus.Fatalln("DRONE_QEMU_SYNC_IMAGES requires DRONE_QEMU_IMAGE_MANIFEST")
+		}
+		err := engine.PullImages(
+			ctx,
+			config.Settings.ImageDir,
+			config.Settings.ImageManifest,
+			nil,
+		)
+		if err != nil {
+			logrus.WithError(err).
+				Errorln("cannot sync images")
+		}
+	}
+
 	engine, err := engine.New(opts)
 	if err != nil {
 		logrus.WithError(err).
 			Fatalln("cannot load the engine")
 	}
+
+	// Run the health checks and block until they pass
+	health := newHealthMonitor(engine.Ping)
 	for {
-		err := engine.Ping(ctx)
-		if err == context.Canceled {
-			break
+		err := health.check(ctx)
+		if ctx.Err() != nil {
+			return nil
 		}
 		if err != nil {
-			logrus.WithError(err).
-				Errorln("cannot ping qemu")
-			time.Sleep(time.Second)
+			time.Sleep(config.Settings.HealthRetry)
 		} else {
 			logrus.Debugln("successfully pinged qemu")
 			break
 		}
 	}
 
+	// Clean up after a previous run that didn't shut down properly
+	if err := engine.Cleanup(ctx); err != nil {
+		logrus.WithError(err).
+			Errorln("cannot clean up stale machines")
+	}
+	if err := engine.CollectVersions(ctx); err != nil {
+		logrus.WithError(err).
+			Errorln("cannot delete unused image versions")
+	}
+
 	remote := remote.New(cli)
 	tracer := history.New(remote)
 	hook := loghistory.New()
@@ -113,7 +165,16 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 		Machine:  config.Runner.Name,
 		Reporter: tracer,
 		Lookup:   resource.Lookup,
-		Lint:     linter.New().Lint,
+		Lint: (&linter.Linter{
+			Limits: linter.Limits{
+				CPUs:     config.Settings.MaxCPUs,
+				Memory:   int64(config.Settings.MaxMemory),
+				DiskSize: int64(config.Settings.MaxDiskSize),
+			},
+			ImageDir:       config.Settings.ImageDir,
+			DefaultImage:   config.Settings.DefaultImage,
+			LimitedRepos:   len(config.Limit.Repos) > 0 || config.Limit.Trusted,
+		}).Lint,
 		Match: match.Func(
 			config.Limit.Repos,
 			config.Limit.Events,
@@ -121,7 +182,9 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 		),
 		Compiler: &compiler.Compiler{
 			Settings: compiler.Settings{
-				DefaultImage: config.Settings.DefaultImage,
+				DefaultImage:   config.Settings.DefaultImage,
+				ImageDir:       config.Settings.ImageDir,
+				DefaultNetwork: config.Settings.Network,
 			},
 			Environ: provider.Combine(
 				provider.Static(config.Runner.Environ),
@@ -150,9 +213,15 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 		).Exec,
 	}
 
-	poller := &poller.Poller{
+	poller := &admissionPoller{
 		Client:   cli,
 		Dispatch: runner.Run,
+		Wait: func(ctx context.Context) error {
+			if err := health.wait(ctx); err != nil {
+				return err
+			}
+			return engine.WaitCapacity(ctx)
+		},
 		Filter: &client.Filter{
 			Kind:    resource.Kind,
 			Type:    resource.Type,
@@ -163,11 +232,11 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 	var g errgroup.Group
 	server := server.Server{
 		Addr: config.Server.Port,
-		Handler: router.New(tracer, hook, router.Config{
+		Handler: withDebug(router.New(tracer, hook, router.Config{
 			Username: config.Dashboard.Username,
 			Password: config.Dashboard.Password,
 			Realm:    config.Dashboard.Realm,
-		}),
+		}), engine, config),
 	}
 
 	logrus.WithField("addr", config.Server.Port).
@@ -199,6 +268,34 @@ func (c *daemonCommand) run(*kingpin.ParseContext) error {
 		}
 	}
 
+	// Keep checking the health, and stop polling if it fails
+	g.Go(func() error {
+		health.run(ctx, config.Settings.HealthInterval)
+		return nil
+	})
+
+	// Periodically clean up machines that leaked, and image
+	// versions that were replaced
+	g.Go(func() error {
+		ticker := time.NewTicker(config.Settings.JanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				if err := engine.Cleanup(ctx); err != nil {
+					logrus.WithError(err).
+						Errorln("cannot clean up stale machines")
+				}
+				if err := engine.CollectVersions(ctx); err != nil {
+					logrus.WithError(err).
+						Errorln("cannot delete unused image versions")
+				}
+			}
+		}
+	})
+
 	g.Go(func() error {
 		logrus.WithField("capacity", config.Runner.Capacity).
 			WithField("endpoint", config.Client.Address).
@@ -0,0 +1,110 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+
+	"github.com/remram44/drone-runner-qemu/engine"
+
+	"github.com/99designs/basicauth-go"
+)
+
+// debugSessions is what the dashboard needs from the engine.
+type debugSessions interface {
+	DebugSessions() []engine.DebugSession
+	CloseDebugSession(id string) bool
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<meta http-equiv="refresh" content="10">
+<title>Debug sessions</title>
+<link rel="stylesheet" type="text/css" href="/static/reset.css">
+<link rel="stylesheet" type="text/css" href="/static/style.css">
+<link rel="icon" type="image/png" id="favicon" href="/static/favicon.png">
+</head>
+<body>
+<header class="navbar">
+    <nav class="inline-nav">
+        <ul>
+            <li><a href="/">Dashboard</a></li>
+            <li><a href="/logs">Logging</a></li>
+            <li><a href="/debug" class="active">Debug sessions</a></li>
+        </ul>
+    </nav>
+</header>
+<main>
+    <section>
+        <header>
+            <h1>Debug sessions</h1>
+        </header>
+        {{ if not . }}
+        <div class="alert sleeping">
+            <p>There are no open debug sessions.</p>
+        </div>
+        {{ end }}
+        {{ range . }}
+        <form method="post" action="/debug">
+            <input type="hidden" name="id" value="{{ .ID }}">
+            <p>
+                Session {{ .ID }}, build {{ .BuildID }}, step {{ .Step }}:
+                {{ .User }} on {{ .Address }} until {{ .Expires.UTC.Format "15:04:05 MST" }}
+                <button type="submit">Close</button>
+            </p>
+        </form>
+        {{ end }}
+    </section>
+</main>
+</body>
+</html>
+`))
+
+// handleDebug lists the open debug sessions, and closes the one
+// whose id is posted.
+func handleDebug(sessions debugSessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		switch r.Method {
+		case http.MethodPost:
+			if !sessions.CloseDebugSession(r.FormValue("id")) {
+				http.Error(w, "no such debug session", http.StatusNotFound)
+				return
+			}
+			http.Redirect(w, r, "/debug", http.StatusSeeOther)
+		case http.MethodGet:
+			list := sessions.DebugSessions()
+			if r.Header.Get("Accept") == "application/json" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(list)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			debugTemplate.Execute(w, list)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// withDebug adds the debug sessions to the dashboard, behind the
+// same authentication. Nothing is added if the dashboard is
+// disabled.
+func withDebug(dashboard http.Handler, sessions debugSessions, config Config) http.Handler {
+	if config.Dashboard.Disabled {
+		return dashboard
+	}
+	auth := basicauth.New(config.Dashboard.Realm, map[string][]string{
+		config.Dashboard.Username: {config.Dashboard.Password},
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/debug", auth(handleDebug(sessions)))
+	mux.Handle("/", dashboard)
+	return mux
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/remram44/drone-runner-qemu/engine"
+
+	"github.com/sirupsen/logrus"
+)
+
+// healthMonitor runs the health checks of the engine, and holds
+// back polling while they fail.
+type healthMonitor struct {
+	ping func(context.Context) error
+
+	mu      sync.Mutex
+	healthy bool
+	changed chan struct{}
+}
+
+func newHealthMonitor(ping func(context.Context) error) *healthMonitor {
+	return &healthMonitor{
+		ping:    ping,
+		changed: make(chan struct{}),
+	}
+}
+
+// check runs the health checks and logs the failures.
+func (h *healthMonitor) check(ctx context.Context) error {
+	err := h.ping(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var health *engine.HealthError
+	if errors.As(err, &health) {
+		for _, check := range health.Checks {
+			logrus.WithError(check.Err).
+				WithField("check", check.Check).
+				Errorln("health check failed")
+		}
+	} else if err != nil {
+		logrus.WithError(err).
+			Errorln("cannot ping qemu")
+	}
+
+	h.mu.Lock()
+	if (err == nil) != h.healthy {
+		h.healthy = err == nil
+		close(h.changed)
+		h.changed = make(chan struct{})
+		if h.healthy {
+			logrus.Infoln("health checks passed")
+		} else {
+			logrus.Warnln("not accepting builds until health checks pass")
+		}
+	}
+	h.mu.Unlock()
+	return err
+}
+
+// run checks the health periodically.
+func (h *healthMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(ctx)
+		}
+	}
+}
+
+// wait blocks until the health checks pass.
+func (h *healthMonitor) wait(ctx context.Context) error {
+	for {
+		h.mu.Lock()
+		healthy, changed := h.healthy, h.changed
+		h.mu.Unlock()
+		if healthy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
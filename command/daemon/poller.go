@@ -0,0 +1,81 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"context"
+	"sync"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/runner-go/client"
+	"github.com/drone/runner-go/logger"
+)
+
+// admissionPoller polls the server for pending stages like poller.Poller,
+// but only while the host has room for another machine.
+type admissionPoller struct {
+	Client client.Client
+	Filter *client.Filter
+
+	// Dispatch is dispatches the resource for processing.
+	Dispatch func(context.Context, *drone.Stage) error
+
+	// Wait blocks until the runner can accept another stage.
+	Wait func(context.Context) error
+}
+
+// Poll opens up to N connections to the server to poll for
+// pending stages for execution.
+func (p *admissionPoller) Poll(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					p.poll(ctx, i+1)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// poll waits for capacity, requests a stage for execution from
+// the server, and then dispatches it for execution.
+func (p *admissionPoller) poll(ctx context.Context, thread int) error {
+	log := logger.FromContext(ctx).WithField("thread", thread)
+
+	// don't take a stage that can't start right away, another
+	// runner might have room for it.
+	if err := p.Wait(ctx); err != nil {
+		return nil
+	}
+
+	log.Debug("poller: request stage from remote server")
+	stage, err := p.Client.Request(ctx, p.Filter)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		log.WithError(err).Trace("poller: no stage returned")
+		return nil
+	}
+	if err != nil {
+		log.WithError(err).Error("poller: cannot request stage")
+		return err
+	}
+
+	// exit if a nil or empty stage is returned from the system
+	// and allow the runner to retry.
+	if stage == nil || stage.ID == 0 {
+		return nil
+	}
+
+	return p.Dispatch(
+		logger.WithContext(nocontext, log), stage)
+}
@@ -52,6 +52,10 @@ type execCommand struct {
 	Dump         bool
 	ImageDir     string
 	TempDir		 string
+	Endpoints    []string
+	DebugVM      bool
+	DebugTimeout time.Duration
+	DebugBind    string
 }
 
 func (c *execCommand) run(*kingpin.ParseContext) error {
@@ -104,12 +108,19 @@ func (c *execCommand) run(*kingpin.ParseContext) error {
 	// lint the pipeline and return an error if any
 	// linting rules are broken
 	lint := linter.New()
+	lint.ImageDir = c.ImageDir
+	lint.DefaultImage = c.Settings.DefaultImage
+
+	// local runs are started by whoever owns the host, and
+	// can use its network.
+	lint.LimitedRepos = true
 	err = lint.Lint(res, c.Repo)
 	if err != nil {
 		return err
 	}
 
 	// compile the pipeline to an intermediate representation.
+	c.Settings.ImageDir = c.ImageDir
 	comp := &compiler.Compiler{
 		Environ:    provider.Static(c.Environ),
 		Settings:   c.Settings,
@@ -128,6 +139,12 @@ func (c *execCommand) run(*kingpin.ParseContext) error {
 	}
 	spec := comp.Compile(nocontext, args).(*engine.Spec)
 
+	// keep the machines running if a step fails, for
+	// debugging.
+	if c.DebugVM {
+		spec.Debug = true
+	}
+
 	// include only steps that are in the include list,
 	// if the list in non-empty.
 	if len(c.Include) > 0 {
@@ -209,9 +226,21 @@ func (c *execCommand) run(*kingpin.ParseContext) error {
 		),
 	)
 
+	var endpoints []engine.Endpoint
+	for _, value := range c.Endpoints {
+		endpoint, err := engine.ParseEndpoint(value)
+		if err != nil {
+			return err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
 	engine, err := engine.New(engine.Opts{
 		ImageDir: c.ImageDir,
 		TempDir: c.TempDir,
+		Endpoints: endpoints,
+		DebugTimeout: c.DebugTimeout,
+		DebugBind: c.DebugBind,
 	})
 	if err != nil {
 		return err
@@ -294,6 +323,24 @@ func registerExec(app *kingpin.Application) {
 	cmd.Flag("default-image", "default image name").
 		StringVar(&c.Settings.DefaultImage)
 
+	cmd.Flag("network", "network policy of pipelines that don't set one: none, restricted or full").
+		Default("full").
+		EnumVar(&c.Settings.DefaultNetwork, "none", "restricted", "full")
+
+	cmd.Flag("network-endpoint", "endpoint reachable with the restricted network policy, as <guest-address>:<port>=<host>:<port>").
+		StringsVar(&c.Endpoints)
+
+	cmd.Flag("debug-vm", "keep the machine running if a step fails, and print how to connect to it over SSH").
+		BoolVar(&c.DebugVM)
+
+	cmd.Flag("debug-timeout", "how long the machine is kept running with --debug-vm").
+		Default("30m").
+		DurationVar(&c.DebugTimeout)
+
+	cmd.Flag("debug-bind", "address that the SSH port is forwarded on with --debug-vm").
+		Default("127.0.0.1").
+		StringVar(&c.DebugBind)
+
 	// shared pipeline flags
 	c.Flags = internal.ParseFlags(cmd)
 }
@@ -0,0 +1,194 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/remram44/drone-runner-qemu/engine"
+
+	"github.com/docker/go-units"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type imagesCommand struct {
+	ImageDir string
+	Name     string
+	Names    []string
+	Manifest string
+	JSON     bool
+	Checksum bool
+	TempDir  string
+	StateDir string
+}
+
+func (c *imagesCommand) list(*kingpin.ParseContext) error {
+	names, err := engine.ListImages(c.ImageDir)
+	if err != nil {
+		return err
+	}
+
+	var images []*engine.ImageInfo
+	for _, name := range names {
+		info, err := engine.InspectImage(nocontext, c.ImageDir, name, c.Checksum)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			if info == nil {
+				continue
+			}
+		}
+		images = append(images, info)
+	}
+
+	if c.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(images)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFORMAT\tVIRTUAL SIZE\tBASE IMAGE\tSHA256")
+	for _, info := range images {
+		size := ""
+		if info.VirtualSize > 0 {
+			size = units.BytesSize(float64(info.VirtualSize))
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\n",
+			info.Name, info.Format, size, info.Config.BaseImage, info.Checksum,
+		)
+	}
+	return w.Flush()
+}
+
+func (c *imagesCommand) inspect(*kingpin.ParseContext) error {
+	info, err := engine.InspectImage(nocontext, c.ImageDir, c.Name, c.Checksum)
+	if err != nil {
+		return err
+	}
+	launch, err := engine.ImageLaunch(c.ImageDir, c.Name, engine.Settings{})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		*engine.ImageInfo
+		Launch *engine.LaunchInfo `json:"launch"`
+	}{info, launch})
+}
+
+func (c *imagesCommand) validate(*kingpin.ParseContext) error {
+	results, err := engine.ValidateImages(nocontext, c.ImageDir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	invalid := 0
+	for _, name := range names {
+		problems := results[name]
+		if len(problems) == 0 {
+			fmt.Printf("%s: ok\n", name)
+			continue
+		}
+		invalid++
+		for _, problem := range problems {
+			fmt.Printf("%s: %v\n", name, problem)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("no images found")
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid images", invalid)
+	}
+	return nil
+}
+
+func (c *imagesCommand) pull(*kingpin.ParseContext) error {
+	return engine.PullImages(nocontext, c.ImageDir, c.Manifest, c.Names)
+}
+
+func (c *imagesCommand) gc(*kingpin.ParseContext) error {
+	eng, err := engine.New(engine.Opts{
+		ImageDir: c.ImageDir,
+		TempDir:  c.TempDir,
+		StateDir: c.StateDir,
+	})
+	if err != nil {
+		return err
+	}
+	return eng.CollectVersions(nocontext)
+}
+
+func registerImages(app *kingpin.Application) {
+	c := new(imagesCommand)
+
+	cmd := app.Command("images", "manage the image catalog")
+
+	cmd.Flag("image-dir", "location of image files").
+		Envar("DRONE_QEMU_IMAGE_DIR").
+		Default(".").
+		StringVar(&c.ImageDir)
+
+	list := cmd.Command("list", "list the images").
+		Action(c.list)
+
+	list.Flag("json", "output the full details as json").
+		BoolVar(&c.JSON)
+
+	list.Flag("checksum", "compute the checksum of the base images").
+		Default("true").
+		BoolVar(&c.Checksum)
+
+	inspect := cmd.Command("inspect", "show the configuration of an image").
+		Action(c.inspect)
+
+	inspect.Arg("name", "image name").
+		Required().
+		StringVar(&c.Name)
+
+	inspect.Flag("checksum", "compute the checksum of the base image").
+		Default("true").
+		BoolVar(&c.Checksum)
+
+	cmd.Command("validate", "check the configuration of all images").
+		Action(c.validate)
+
+	pull := cmd.Command("pull", "download images from a manifest").
+		Action(c.pull)
+
+	pull.Flag("manifest", "location of the image manifest, a path or url").
+		Envar("DRONE_QEMU_IMAGE_MANIFEST").
+		Required().
+		StringVar(&c.Manifest)
+
+	pull.Arg("names", "images to download, all if none").
+		StringsVar(&c.Names)
+
+	gc := cmd.Command("gc", "delete image versions that are no longer used").
+		Action(c.gc)
+
+	gc.Flag("temp-dir", "temporary directory of the runner").
+		Envar("DRONE_QEMU_TEMP_DIR").
+		StringVar(&c.TempDir)
+
+	gc.Flag("state-dir", "directory where the runner records its machines").
+		Envar("DRONE_QEMU_STATE_DIR").
+		StringVar(&c.StateDir)
+
+	registerBuild(cmd, &c.ImageDir)
+}
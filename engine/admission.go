@@ -0,0 +1,160 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// admission keeps track of the memory and CPUs committed to running
+// machines, and holds back new machines until they fit on the host.
+type admission struct {
+	memory int // MiB
+	cpus   int
+
+	mu         sync.Mutex
+	usedMemory int
+	usedCPUs   int
+	waiting    int
+
+	// Closed and replaced every time resources are released or a
+	// machine stops waiting
+	changed chan struct{}
+}
+
+func newAdmission(memory int, cpus int) *admission {
+	return &admission{
+		memory:  memory,
+		cpus:    cpus,
+		changed: make(chan struct{}),
+	}
+}
+
+// hostResources returns the total memory in MiB and the number of
+// CPUs of the host.
+func hostResources() (int, int, error) {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0, 0, err
+	}
+	memory := int(uint64(info.Totalram) * uint64(info.Unit) / (1024 * 1024))
+	return memory, runtime.NumCPU(), nil
+}
+
+func (a *admission) fits(memory int, cpus int) bool {
+	return a.usedMemory+memory <= a.memory && a.usedCPUs+cpus <= a.cpus
+}
+
+// acquire reserves resources for a machine, waiting until they are
+// available. The returned function releases them.
+func (a *admission) acquire(ctx context.Context, memory int, cpus int) (func(), error) {
+	releases, err := a.acquireGroup(ctx, []int{memory}, []int{cpus})
+	if err != nil {
+		return nil, err
+	}
+	return releases[0], nil
+}
+
+// acquireGroup reserves resources for machines that run together,
+// all at once, waiting until they are available. Taking them one
+// at a time could leave pipelines each holding part of what they
+// need, waiting for each other. Each returned function releases
+// the share of one machine.
+func (a *admission) acquireGroup(ctx context.Context, memory []int, cpus []int) ([]func(), error) {
+	totalMemory, totalCPUs := 0, 0
+	for i := range memory {
+		totalMemory += memory[i]
+		totalCPUs += cpus[i]
+	}
+	if totalMemory > a.memory || totalCPUs > a.cpus {
+		if len(memory) == 1 {
+			return nil, fmt.Errorf(
+				"machine needs %d MiB and %d CPUs, more than the runner has (%d MiB, %d CPUs)",
+				totalMemory, totalCPUs, a.memory, a.cpus,
+			)
+		}
+		return nil, fmt.Errorf(
+			"machines need %d MiB and %d CPUs together, more than the runner has (%d MiB, %d CPUs)",
+			totalMemory, totalCPUs, a.memory, a.cpus,
+		)
+	}
+
+	a.mu.Lock()
+	waiting := false
+	for !a.fits(totalMemory, totalCPUs) {
+		if !waiting {
+			waiting = true
+			a.waiting++
+		}
+		changed := a.changed
+		a.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			a.mu.Lock()
+			a.waiting--
+			a.notify()
+			a.mu.Unlock()
+			return nil, ctx.Err()
+		case <-changed:
+		}
+		a.mu.Lock()
+	}
+	if waiting {
+		a.waiting--
+		a.notify()
+	}
+	a.usedMemory += totalMemory
+	a.usedCPUs += totalCPUs
+	a.mu.Unlock()
+
+	releases := make([]func(), len(memory))
+	for i := range memory {
+		releases[i] = a.releaser(memory[i], cpus[i])
+	}
+	return releases, nil
+}
+
+// releaser returns a function releasing resources, once.
+func (a *admission) releaser(memory int, cpus int) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			a.usedMemory -= memory
+			a.usedCPUs -= cpus
+			a.notify()
+			a.mu.Unlock()
+		})
+	}
+}
+
+// notify wakes up everyone waiting for a change. Must be called
+// with the lock held.
+func (a *admission) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// wait blocks until no machine is held back and some resources are
+// free, so that it makes sense to accept another build.
+func (a *admission) wait(ctx context.Context) error {
+	a.mu.Lock()
+	for a.waiting > 0 || a.usedMemory >= a.memory || a.usedCPUs >= a.cpus {
+		changed := a.changed
+		a.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+		a.mu.Lock()
+	}
+	a.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(4096, 4)
+
+	release1, err := a.acquire(nocontext, 2048, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.wait(nocontext); err != nil {
+		t.Fatal(err)
+	}
+
+	// Too big for the host
+	if _, err := a.acquire(nocontext, 8192, 1); err == nil {
+		t.Errorf("Expected error for a machine larger than the host")
+	}
+
+	// Doesn't fit until the first machine is gone
+	acquired := make(chan func())
+	go func() {
+		release, err := a.acquire(nocontext, 3072, 2)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Machine was admitted while the host is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// No more builds should be taken while one is held back
+	ctx, cancel := context.WithTimeout(nocontext, 50*time.Millisecond)
+	defer cancel()
+	if err := a.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected wait to block, got %v", err)
+	}
+
+	release1()
+	release1()
+	var release2 func()
+	select {
+	case release2 = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Machine was not admitted after resources were released")
+	}
+	if a.usedMemory != 3072 || a.usedCPUs != 2 {
+		t.Errorf("Unexpected usage %d MiB, %d CPUs", a.usedMemory, a.usedCPUs)
+	}
+	release2()
+	if err := a.wait(nocontext); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmission_Cancel(t *testing.T) {
+	a := newAdmission(1024, 1)
+	release, err := a.acquire(nocontext, 1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(nocontext, 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.acquire(ctx, 1024, 1); err != context.DeadlineExceeded {
+		t.Errorf("Expected acquire to time out, got %v", err)
+	}
+	if a.waiting != 0 {
+		t.Errorf("Expected no waiting machine, got %d", a.waiting)
+	}
+}
+
+func TestAdmission_Group(t *testing.T) {
+	a := newAdmission(4096, 4)
+
+	// Each machine fits, but not all of them together
+	if _, err := a.acquireGroup(nocontext, []int{3072, 3072}, []int{1, 1}); err == nil {
+		t.Errorf("Expected error for machines larger than the host together")
+	}
+
+	releases, err := a.acquireGroup(nocontext, []int{2048, 1024}, []int{2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.usedMemory != 3072 || a.usedCPUs != 3 {
+		t.Errorf("Unexpected usage %d MiB, %d CPUs", a.usedMemory, a.usedCPUs)
+	}
+
+	// Another group waits for all of its resources, without
+	// holding any of them meanwhile
+	acquired := make(chan []func())
+	go func() {
+		releases, err := a.acquireGroup(nocontext, []int{1024, 1024}, []int{1, 1})
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- releases
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Group was admitted while the host is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.mu.Lock()
+	if a.usedMemory != 3072 || a.usedCPUs != 3 {
+		t.Errorf("Waiting group holds resources, usage %d MiB, %d CPUs", a.usedMemory, a.usedCPUs)
+	}
+	a.mu.Unlock()
+
+	// Releasing one machine is enough
+	releases[0]()
+	var releases2 []func()
+	select {
+	case releases2 = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Group was not admitted after resources were released")
+	}
+	releases[1]()
+	for _, release := range releases2 {
+		release()
+	}
+	if a.usedMemory != 0 || a.usedCPUs != 0 {
+		t.Errorf("Unexpected usage %d MiB, %d CPUs", a.usedMemory, a.usedCPUs)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// UEFI firmware used for aarch64 guests if the image doesn't set
+// one, from Debian's qemu-efi-aarch64 package
+const AARCH64_FIRMWARE = "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"
+
+// Qemu names of the architectures Drone knows about
+var qemuArches = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "i386",
+	"arm64":   "aarch64",
+	"arm":     "arm",
+	"ppc64le": "ppc64",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// QemuArch returns the Qemu name of an architecture, given as in
+// the platform section of a pipeline, for example "aarch64" for
+// "arm64". Names Qemu already uses are returned unchanged.
+func QemuArch(arch string) string {
+	if qemu, ok := qemuArches[arch]; ok {
+		return qemu
+	}
+	return arch
+}
+
+// hostArch returns the Qemu name of the host's architecture.
+func hostArch() string {
+	return QemuArch(runtime.GOARCH)
+}
+
+// ResolveImage returns the variant of an image for a platform
+// architecture: the image itself if it is for that architecture,
+// otherwise "<name>-<arch>", with either name of the architecture.
+// It returns an error if there is no such image, or if it can't run
+// on this host.
+func ResolveImage(imageDir string, name string, arch string) (string, error) {
+	if arch == "" {
+		return name, nil
+	}
+	want := QemuArch(arch)
+	candidates := []string{name, name + "-" + arch}
+	if want != arch {
+		candidates = append(candidates, name+"-"+want)
+	}
+	found := false
+	for _, candidate := range candidates {
+		config, err := loadMachineConfig(imageDir, candidate)
+		if err != nil {
+			continue
+		}
+		found = true
+		if config.Arch == want {
+			if err := checkRunnable(config); err != nil {
+				return "", fmt.Errorf("image %s can't run on this host: %w", candidate, err)
+			}
+			return candidate, nil
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("unknown image %s", name)
+	}
+	return "", fmt.Errorf("image %s has no variant for %s", name, arch)
+}
+
+// checkRunnable returns an error if the host can't launch machines
+// of the given configuration.
+func checkRunnable(config MachineConfig) error {
+	if config.Script != "" {
+		// Anything goes
+		return nil
+	}
+	if config.Accel == "kvm" && config.Arch != hostArch() {
+		return fmt.Errorf("KVM can't run %s guests on a %s host", config.Arch, hostArch())
+	}
+	if _, err := exec.LookPath(config.Binary); err != nil {
+		return err
+	}
+	if config.Firmware != "" {
+		if _, err := os.Stat(config.Firmware); err != nil {
+			return fmt.Errorf("missing firmware: %w", err)
+		}
+	}
+	return nil
+}
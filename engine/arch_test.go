@@ -0,0 +1,67 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQemuArch(t *testing.T) {
+	for arch, expected := range map[string]string{
+		"amd64":   "x86_64",
+		"arm64":   "aarch64",
+		"aarch64": "aarch64",
+		"":        "",
+	} {
+		if got := QemuArch(arch); got != expected {
+			t.Errorf("QemuArch(%q) = %q, expected %q", arch, got, expected)
+		}
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, config string) {
+		os.WriteFile(filepath.Join(dir, name+".qemu.json"), []byte(config), 0644)
+	}
+	write("debian", `{"arch": "x86_64", "script": "run.sh"}`)
+	write("debian-arm64", `{"arch": "aarch64", "script": "run.sh"}`)
+	write("fedora", `{"arch": "x86_64", "script": "run.sh"}`)
+	write("fedora-aarch64", `{"arch": "aarch64", "script": "run.sh"}`)
+	write("alpine", `{"arch": "x86_64", "script": "run.sh"}`)
+	write("broken", `{"arch": "aarch64", "accel": "kvm"}`)
+
+	tests := []struct {
+		name     string
+		arch     string
+		expected string
+		invalid  bool
+	}{
+		{name: "debian", arch: "", expected: "debian"},
+		{name: "debian", arch: "amd64", expected: "debian"},
+		{name: "debian", arch: "arm64", expected: "debian-arm64"},
+		{name: "fedora", arch: "arm64", expected: "fedora-aarch64"},
+		{name: "fedora-aarch64", arch: "arm64", expected: "fedora-aarch64"},
+		{name: "alpine", arch: "arm64", invalid: true},
+		{name: "missing", arch: "arm64", invalid: true},
+		{name: "broken", arch: "arm64", invalid: hostArch() != "aarch64"},
+	}
+	for _, test := range tests {
+		got, err := ResolveImage(dir, test.name, test.arch)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("Expected error for %s on %q, got %q", test.name, test.arch, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s on %q: %v", test.name, test.arch, err)
+		} else if got != test.expected {
+			t.Errorf("Expected %s on %q to be %q, got %q", test.name, test.arch, test.expected, got)
+		}
+	}
+}
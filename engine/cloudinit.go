@@ -0,0 +1,151 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"strings"
+
+	"github.com/buildkite/yaml"
+	"github.com/dchest/uniuri"
+	"golang.org/x/crypto/ssh"
+)
+
+// lowercase letters and digits, valid in hostnames
+var idChars = []byte("abcdefghijklmnopqrstuvwxyz0123456789")
+
+// newMachineID returns a random identifier for a machine, used
+// for its files, instance-id and hostname.
+func newMachineID() string {
+	return uniuri.NewLenChars(16, idChars)
+}
+
+// newKey generates an SSH key pair.
+func newKey() (ed25519.PrivateKey, ssh.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, signer, nil
+}
+
+// cloudConfig is the user-data given to cloud-init.
+type cloudConfig struct {
+	Password          string            `yaml:"password,omitempty"`
+	Chpasswd          map[string]bool   `yaml:"chpasswd,omitempty"`
+	SSHPwauth         bool              `yaml:"ssh_pwauth"`
+	SSHAuthorizedKeys []string          `yaml:"ssh_authorized_keys,omitempty"`
+	SSHKeys           map[string]string `yaml:"ssh_keys,omitempty"`
+	RunCmd            []string          `yaml:"runcmd,omitempty"`
+	Growpart          *growpartConfig   `yaml:"growpart,omitempty"`
+	ResizeRootfs      bool              `yaml:"resize_rootfs,omitempty"`
+}
+
+// growpartConfig configures the growpart module of cloud-init, which
+// grows partitions to fill the disk.
+type growpartConfig struct {
+	Mode    string   `yaml:"mode"`
+	Devices []string `yaml:"devices"`
+}
+
+// seed is the NoCloud data source of a machine.
+type seed struct {
+	InstanceID    string
+	Hostname      string
+	AuthorizedKey ssh.PublicKey
+
+	// HostKey is installed as the ed25519 key of the SSH server
+	// if set, so that it can be pinned by the client.
+	HostKey ed25519.PrivateKey
+
+	// RunCommands are run by the guest once it is done booting
+	RunCommands []string
+
+	// GrowRoot has the guest grow its root partition and
+	// filesystem to fill the disk, after it was resized
+	GrowRoot bool
+}
+
+func (s *seed) metaData() ([]byte, error) {
+	return yaml.Marshal(map[string]string{
+		"instance-id":    s.InstanceID,
+		"local-hostname": s.Hostname,
+	})
+}
+
+func (s *seed) userData() ([]byte, error) {
+	config := cloudConfig{
+		// Random password that nobody knows, so the account is
+		// usable with sudo
+		Password:  uniuri.NewLen(32),
+		Chpasswd:  map[string]bool{"expire": false},
+		SSHPwauth: false,
+		SSHAuthorizedKeys: []string{
+			strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.AuthorizedKey))),
+		},
+		RunCmd: s.RunCommands,
+	}
+	if s.GrowRoot {
+		config.Growpart = &growpartConfig{
+			Mode:    "auto",
+			Devices: []string{"/"},
+		}
+		config.ResizeRootfs = true
+	}
+	if s.HostKey != nil {
+		block, err := ssh.MarshalPrivateKey(s.HostKey, "")
+		if err != nil {
+			return nil, err
+		}
+		public, err := ssh.NewPublicKey(s.HostKey.Public())
+		if err != nil {
+			return nil, err
+		}
+		config.SSHKeys = map[string]string{
+			"ed25519_private": string(pem.EncodeToMemory(block)),
+			"ed25519_public":  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public))),
+		}
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), data...), nil
+}
+
+// writeImage writes the seed as an ISO9660 image labelled
+// "cidata", which cloud-init picks up as a NoCloud data source.
+func (s *seed) writeImage(filename string) error {
+	metaData, err := s.metaData()
+	if err != nil {
+		return err
+	}
+	userData, err := s.userData()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeISO(file, "cidata", []isoFile{
+		{Name: "meta-data", Data: metaData},
+		{Name: "user-data", Data: userData},
+	})
+	if err != nil {
+		file.Close()
+		os.Remove(filename)
+		return err
+	}
+	return file.Close()
+}
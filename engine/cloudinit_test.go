@@ -0,0 +1,152 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/yaml"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewMachineID(t *testing.T) {
+	a, b := newMachineID(), newMachineID()
+	if a == b {
+		t.Errorf("Expected unique IDs, got %q twice", a)
+	}
+	if strings.ToLower(a) != a {
+		t.Errorf("Expected lowercase ID, got %q", a)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	_, key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, hostSigner, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &seed{
+		InstanceID:    "drone-abc",
+		Hostname:      "drone-abc",
+		AuthorizedKey: key.PublicKey(),
+		HostKey:       hostKey,
+	}
+
+	data, err := s.userData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "#cloud-config\n") {
+		t.Errorf("user-data doesn't start with #cloud-config")
+	}
+	var config cloudConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.SSHAuthorizedKeys) != 1 {
+		t.Fatalf("Expected one authorized key, got %d", len(config.SSHAuthorizedKeys))
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.SSHAuthorizedKeys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(parsed.Marshal()) != string(key.PublicKey().Marshal()) {
+		t.Errorf("Authorized key doesn't match the generated key")
+	}
+
+	// The host key is installed in the guest
+	private, err := ssh.ParsePrivateKey([]byte(config.SSHKeys["ed25519_private"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(private.PublicKey().Marshal()) != string(hostSigner.PublicKey().Marshal()) {
+		t.Errorf("Host private key doesn't match the generated key")
+	}
+	public, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.SSHKeys["ed25519_public"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(public.Marshal()) != string(hostSigner.PublicKey().Marshal()) {
+		t.Errorf("Host public key doesn't match the generated key")
+	}
+
+	data, err = s.metaData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta map[string]string
+	yaml.Unmarshal(data, &meta)
+	if meta["instance-id"] != "drone-abc" || meta["local-hostname"] != "drone-abc" {
+		t.Errorf("Unexpected meta-data %v", meta)
+	}
+
+	filename := filepath.Join(t.TempDir(), "seed.iso")
+	if err := s.writeImage(filename); err != nil {
+		t.Fatal(err)
+	}
+	image, _ := os.ReadFile(filename)
+	files := readISORoot(t, image, isoJolietSector)
+	if _, ok := files["user-data"]; !ok {
+		t.Errorf("Missing user-data in seed image")
+	}
+	if _, ok := files["meta-data"]; !ok {
+		t.Errorf("Missing meta-data in seed image")
+	}
+}
+
+func TestSeed_NoHostKey(t *testing.T) {
+	_, key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &seed{
+		InstanceID:    "drone-abc",
+		Hostname:      "drone-abc",
+		AuthorizedKey: key.PublicKey(),
+	}
+	data, err := s.userData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "ssh_keys") {
+		t.Errorf("Expected no host keys in user-data")
+	}
+	if strings.Contains(string(data), "growpart") {
+		t.Errorf("Expected no growpart in user-data")
+	}
+}
+
+func TestSeed_GrowRoot(t *testing.T) {
+	_, key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &seed{
+		InstanceID:    "drone-abc",
+		Hostname:      "drone-abc",
+		AuthorizedKey: key.PublicKey(),
+		GrowRoot:      true,
+	}
+	data, err := s.userData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config cloudConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Growpart == nil || config.Growpart.Mode != "auto" || len(config.Growpart.Devices) != 1 || config.Growpart.Devices[0] != "/" {
+		t.Errorf("Unexpected growpart config %+v", config.Growpart)
+	}
+	if !config.ResizeRootfs {
+		t.Errorf("Expected resize_rootfs")
+	}
+}
@@ -30,6 +30,13 @@ var random = func() string {
 // Settings defines default settings.
 type Settings struct {
 	DefaultImage string
+
+	// Where images are looked up to pick the variant for the
+	// pipeline's platform, if set
+	ImageDir string
+
+	// Network policy of pipelines that don't set one
+	DefaultNetwork string
 }
 
 // Compiler compiles the Yaml configuration file to an
@@ -58,10 +65,46 @@ func (c *Compiler) Compile(ctx context.Context, args runtime.CompilerArgs) runti
 		image = pipeline.Image
 	}
 
+	network := c.Settings.DefaultNetwork
+	if pipeline.Network != "" {
+		network = pipeline.Network
+	}
+
+	arch := pipeline.Platform.Arch
 	spec := &engine.Spec{
 		Settings: engine.Settings{
-			Image: image,
+			Image:    c.resolveImage(image, arch),
+			OS:       os,
+			Arch:     engine.QemuArch(arch),
+			CPUs:     pipeline.VM.CPUs,
+			Memory:   int64(pipeline.VM.Memory),
+			DiskSize: int64(pipeline.VM.DiskSize),
+			Network:  network,
+			BuildID:  args.Build.ID,
 		},
+		Debug: pipeline.Debug,
+	}
+
+	// create the machines, which default to the pipeline's
+	// image and resources.
+	for _, src := range pipeline.Machines {
+		settings := spec.Settings
+		if src.Image != "" {
+			settings.Image = c.resolveImage(src.Image, arch)
+		}
+		if src.VM.CPUs != 0 {
+			settings.CPUs = src.VM.CPUs
+		}
+		if src.VM.Memory != 0 {
+			settings.Memory = int64(src.VM.Memory)
+		}
+		if src.VM.DiskSize != 0 {
+			settings.DiskSize = int64(src.VM.DiskSize)
+		}
+		spec.Machines = append(spec.Machines, &engine.MachineSpec{
+			Name:     src.Name,
+			Settings: settings,
+		})
 	}
 
 	// IMPORTANT:
@@ -207,6 +250,18 @@ func (c *Compiler) Compile(ctx context.Context, args runtime.CompilerArgs) runti
 			Secrets:    []*engine.Secret{},
 			WorkingDir: sourcedir,
 		})
+
+		// every machine gets its own copy of the source.
+		for i, machine := range spec.Machines {
+			if i == 0 {
+				spec.Steps[0].Machine = machine.Name
+				continue
+			}
+			clone := *spec.Steps[0]
+			clone.Name = "clone-" + machine.Name
+			clone.Machine = machine.Name
+			spec.Steps = append(spec.Steps, &clone)
+		}
 	}
 
 	// create steps
@@ -222,6 +277,7 @@ func (c *Compiler) Compile(ctx context.Context, args runtime.CompilerArgs) runti
 			Command:   cmd,
 			Detach:    src.Detach,
 			DependsOn: src.DependsOn,
+			Machine:   src.Machine,
 			Envs: environ.Combine(envs,
 				environ.Expand(
 					convertStaticEnv(src.Environment),
@@ -264,6 +320,51 @@ func (c *Compiler) Compile(ctx context.Context, args runtime.CompilerArgs) runti
 		removeCloneDeps(spec)
 	}
 
+	// create services, which run in the background while the
+	// steps that wait for them run.
+	var services []*engine.Step
+	for _, src := range pipeline.Services {
+		serviceslug := slug.Make(src.Name)
+		servicepath := join(os, spec.Root, "opt", getExt(os, serviceslug))
+		servicefile := genScript(os, src.Commands)
+
+		workingdir := sourcedir
+		if src.WorkingDir != "" {
+			workingdir = src.WorkingDir
+		}
+
+		cmd, args := getCommand(os, servicepath)
+		services = append(services, &engine.Step{
+			Name:    src.Name,
+			Args:    args,
+			Command: cmd,
+			Detach:  true,
+			Envs: environ.Combine(envs,
+				environ.Expand(
+					convertStaticEnv(src.Environment),
+				),
+			),
+			Machine:   src.Machine,
+			Probe:     convertProbe(src.Probe),
+			RunPolicy: runtime.RunAlways,
+			Files: []*engine.File{
+				{
+					Path: servicepath,
+					Mode: 0700,
+					Data: []byte(servicefile),
+				},
+			},
+			Secrets:    convertSecretEnv(src.Environment),
+			WorkingDir: workingdir,
+		})
+	}
+	if len(services) > 0 {
+		configureServices(spec, services)
+	}
+	if len(spec.Machines) > 1 && pipeline.Clone.Disable == false {
+		configureMachineClones(spec)
+	}
+
 	for _, step := range spec.Steps {
 		for _, s := range step.Secrets {
 			secret, ok := c.findSecret(ctx, args, s.Name)
@@ -276,6 +377,18 @@ func (c *Compiler) Compile(ctx context.Context, args runtime.CompilerArgs) runti
 	return spec
 }
 
+// helper function returns the variant of the image for the
+// platform. If there is none, the linter rejects the pipeline,
+// and booting fails.
+func (c *Compiler) resolveImage(image, arch string) string {
+	if c.Settings.ImageDir != "" {
+		if variant, err := engine.ResolveImage(c.Settings.ImageDir, image, arch); err == nil {
+			return variant
+		}
+	}
+	return image
+}
+
 // helper function attempts to find and return the named secret.
 // from the secret provider.
 func (c *Compiler) findSecret(ctx context.Context, args runtime.CompilerArgs, name string) (s string, ok bool) {
@@ -39,33 +39,97 @@ func notRandom() string {
 // dependency graph is defined, a default dependency graph is
 // automatically defined to run steps serially.
 func TestCompile_Serial(t *testing.T) {
-	testCompile(t, "testdata/serial.yml", "testdata/serial.json")
+	testCompile(t, "testdata/serial.yml", "testdata/serial.json", Settings{})
 }
 
 // This test verifies the pipeline dependency graph. It also
 // verifies that pipeline steps with no dependencies depend on
 // the initial clone step.
 func TestCompile_Graph(t *testing.T) {
-	testCompile(t, "testdata/graph.yml", "testdata/graph.json")
+	testCompile(t, "testdata/graph.yml", "testdata/graph.json", Settings{})
 }
 
 // This test verifies no clone step exists in the pipeline if
 // cloning is disabled.
 func TestCompile_CloneDisabled_Serial(t *testing.T) {
-	testCompile(t, "testdata/noclone_serial.yml", "testdata/noclone_serial.json")
+	testCompile(t, "testdata/noclone_serial.yml", "testdata/noclone_serial.json", Settings{})
 }
 
 // This test verifies no clone step exists in the pipeline if
 // cloning is disabled. It also verifies no pipeline steps
 // depend on a clone step.
 func TestCompile_CloneDisabled_Graph(t *testing.T) {
-	testCompile(t, "testdata/noclone_graph.yml", "testdata/noclone_graph.json")
+	testCompile(t, "testdata/noclone_graph.yml", "testdata/noclone_graph.json", Settings{})
+}
+
+// This test verifies that services run in the background after
+// the clone step, and that the other steps depend on them.
+func TestCompile_Services(t *testing.T) {
+	ir := testCompile(t, "testdata/services.yml", "testdata/services.json", Settings{})
+	if !ir.Steps[1].Detach || ir.Steps[1].Probe == nil {
+		t.Errorf("Expect detached service with a probe")
+	}
+}
+
+// This test verifies that steps and services run on the machine
+// they name, that each machine clones the source, and that the
+// machines default to the pipeline's image and resources.
+func TestCompile_Machines(t *testing.T) {
+	ir := testCompile(t, "testdata/machines.yml", "testdata/machines.json", Settings{})
+	if len(ir.Machines) != 2 || ir.Machines[1].Settings.Image != "fedora-40" {
+		t.Errorf("Expect client and server machines")
+	}
+}
+
+// This test verifies that the resources of the virtual machine
+// are carried into the pipeline settings.
+func TestCompile_VM(t *testing.T) {
+	ir := testCompile(t, "testdata/vm.yml", "testdata/vm.json", Settings{})
+	if ir.Settings.CPUs != 8 {
+		t.Errorf("Expect 8 cpus")
+	}
+}
+
+// This test verifies that the variant of the image for the
+// platform's architecture is picked.
+func TestCompile_Arch(t *testing.T) {
+	ir := testCompile(t, "testdata/arch.yml", "testdata/arch.json", Settings{ImageDir: "testdata/images"})
+	if ir.Settings.Image != "debian-12-arm64" || ir.Settings.Arch != "aarch64" {
+		t.Errorf("Unexpected image %q for %q", ir.Settings.Image, ir.Settings.Arch)
+	}
+}
+
+// This test verifies that the network policy of the pipeline
+// overrides the default one.
+func TestCompile_Network(t *testing.T) {
+	ir := testCompile(t, "testdata/network.yml", "testdata/network.json", Settings{DefaultNetwork: "restricted"})
+	if ir.Settings.Network != "none" {
+		t.Errorf("Expect network none, got %q", ir.Settings.Network)
+	}
+}
+
+// This test verifies that the default network policy applies
+// when the pipeline doesn't set one.
+func TestCompile_NetworkDefault(t *testing.T) {
+	ir := testCompile(t, "testdata/network_default.yml", "testdata/network_default.json", Settings{DefaultNetwork: "restricted"})
+	if ir.Settings.Network != "restricted" {
+		t.Errorf("Expect network restricted, got %q", ir.Settings.Network)
+	}
+}
+
+// This test verifies that debug mode is passed on to the
+// engine.
+func TestCompile_Debug(t *testing.T) {
+	ir := testCompile(t, "testdata/debug.yml", "testdata/debug.json", Settings{})
+	if !ir.Debug {
+		t.Errorf("Expect debug mode")
+	}
 }
 
 // This test verifies that steps are disabled if conditions
 // defined in the when block are not satisfied.
 func TestCompile_Match(t *testing.T) {
-	ir := testCompile(t, "testdata/match.yml", "testdata/match.json")
+	ir := testCompile(t, "testdata/match.yml", "testdata/match.json", Settings{})
 	if ir.Steps[0].RunPolicy != runtime.RunOnSuccess {
 		t.Errorf("Expect run on success")
 	}
@@ -77,7 +141,7 @@ func TestCompile_Match(t *testing.T) {
 // This test verifies that steps configured to run on both
 // success or failure are configured to always run.
 func TestCompile_RunAlways(t *testing.T) {
-	ir := testCompile(t, "testdata/run_always.yml", "testdata/run_always.json")
+	ir := testCompile(t, "testdata/run_always.yml", "testdata/run_always.json", Settings{})
 	if ir.Steps[0].RunPolicy != runtime.RunAlways {
 		t.Errorf("Expect run always")
 	}
@@ -86,7 +150,7 @@ func TestCompile_RunAlways(t *testing.T) {
 // This test verifies that steps configured to run on failure
 // are configured to run on failure.
 func TestCompile_RunFailure(t *testing.T) {
-	ir := testCompile(t, "testdata/run_failure.yml", "testdata/run_failure.json")
+	ir := testCompile(t, "testdata/run_failure.yml", "testdata/run_failure.json", Settings{})
 	if ir.Steps[0].RunPolicy != runtime.RunOnFailure {
 		t.Errorf("Expect run on failure")
 	}
@@ -140,9 +204,9 @@ func TestCompile_Secrets(t *testing.T) {
 	}
 }
 
-// helper function parses and compiles the source file and then
-// compares to a golden json file.
-func testCompile(t *testing.T, source, golden string) *engine.Spec {
+// helper function parses and compiles the source file with the
+// given settings and then compares to a golden json file.
+func testCompile(t *testing.T, source, golden string, settings Settings) *engine.Spec {
 	// replace the default random function with one that
 	// is deterministic, for testing purposes.
 	random = notRandom
@@ -166,6 +230,7 @@ func testCompile(t *testing.T, source, golden string) *engine.Spec {
 			"password":    "password",
 			"my_username": "octocat",
 		}),
+		Settings: settings,
 	}
 	args := runtime.CompilerArgs{
 		Repo:     &drone.Repo{},
@@ -6,6 +6,7 @@ package compiler
 
 import (
 	"strings"
+	"time"
 
 	"github.com/remram44/drone-runner-qemu/engine"
 	"github.com/remram44/drone-runner-qemu/engine/resource"
@@ -121,3 +122,90 @@ func removeCloneDeps(spec *engine.Spec) {
 		}
 	}
 }
+
+// helper function converts the readiness probe of a service.
+func convertProbe(src *resource.Probe) *engine.Probe {
+	if src == nil {
+		return nil
+	}
+	return &engine.Probe{
+		Port:    src.Port,
+		Command: src.Command,
+		Timeout: time.Duration(src.Timeout) * time.Second,
+	}
+}
+
+// helper function returns the names of the clone steps, one for
+// each machine of the pipeline.
+func cloneSteps(spec *engine.Spec) []string {
+	names := []string{"clone"}
+	for i, machine := range spec.Machines {
+		if i > 0 {
+			names = append(names, "clone-"+machine.Name)
+		}
+	}
+	return names
+}
+
+// helper function returns true if the step is a clone step.
+func isCloneStep(spec *engine.Spec, step *engine.Step) bool {
+	return contains(cloneSteps(spec), step.Name)
+}
+
+// helper function returns true if the list contains the name.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function adds the services to the pipeline dependency
+// graph. services start after the clone steps, and every other
+// step depends on all of them, so it waits for them to be ready.
+func configureServices(spec *engine.Spec, services []*engine.Step) {
+	var names []string
+	for _, service := range services {
+		names = append(names, service.Name)
+	}
+	var clones, steps []*engine.Step
+	for _, step := range spec.Steps {
+		if isCloneStep(spec, step) {
+			clones = append(clones, step)
+			continue
+		}
+		step.DependsOn = append(append([]string{}, step.DependsOn...), names...)
+		steps = append(steps, step)
+	}
+	if len(clones) > 0 {
+		var dependsOn []string
+		for _, clone := range clones {
+			dependsOn = append(dependsOn, clone.Name)
+		}
+		for _, service := range services {
+			service.DependsOn = dependsOn
+		}
+	}
+	spec.Steps = append(append(clones, services...), steps...)
+}
+
+// helper function modifies the pipeline dependency graph so that
+// the steps that depend on the clone step also depend on the clone
+// steps of the other machines.
+func configureMachineClones(spec *engine.Spec) {
+	clones := cloneSteps(spec)[1:]
+	for _, step := range spec.Steps {
+		if isCloneStep(spec, step) || !contains(step.DependsOn, "clone") {
+			continue
+		}
+		dependsOn := append([]string{}, step.DependsOn...)
+		for _, name := range clones {
+			if !contains(dependsOn, name) {
+				dependsOn = append(dependsOn, name)
+			}
+		}
+		step.DependsOn = dependsOn
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+const BOOT_MAX_DELAY time.Duration = 3 * time.Minute
+
+// Machine configuration, loaded from JSON
+type MachineConfig struct {
+	Username        string `json:"username,omitempty"`
+	BaseImage       string `json:"base_image,omitempty"`
+	BaseImageFormat string `json:"base_image_format,omitempty"`
+
+	// Checksum of the base image, recorded when it is pulled
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Image this one was built from
+	Parent string `json:"parent,omitempty"`
+
+	// Don't install and verify a host key, for images whose
+	// cloud-init can't set the SSH server's keys
+	InsecureIgnoreHostKey bool `json:"insecure_ignore_host_key,omitempty"`
+
+	Readiness ReadinessConfig `json:"readiness,omitempty"`
+
+	// Size the disk is grown to, such as "20GiB"; the pipeline
+	// can ask for more
+	DiskSize string `json:"disk_size,omitempty"`
+	diskSize int64
+
+	// Script that runs Qemu, instead of the command line built
+	// from the settings below. Defaults to <name>.qemu.sh if it
+	// exists
+	Script string `json:"script,omitempty"`
+
+	// The script passes QEMU_NETDEV_OPTIONS to its user-mode
+	// network backends, so it can run pipelines whose network
+	// is restricted
+	EnforcesNetwork bool `json:"enforces_network,omitempty"`
+
+	// Machine description, used to build the Qemu command line
+	Arch      string       `json:"arch,omitempty"`
+	Binary    string       `json:"binary,omitempty"`
+	Machine   string       `json:"machine,omitempty"`
+	Accel     string       `json:"accel,omitempty"`
+	CPU       string       `json:"cpu,omitempty"`
+	Memory    int          `json:"memory,omitempty"`
+	SMP       int          `json:"smp,omitempty"`
+	Firmware  string       `json:"firmware,omitempty"`
+	Disks     []DiskConfig `json:"disks,omitempty"`
+	NICs      []NICConfig  `json:"nics,omitempty"`
+	ExtraArgs []string     `json:"extra_args,omitempty"`
+}
+
+// DiskConfig is an additional disk attached to the machine.
+type DiskConfig struct {
+	File      string `json:"file"`
+	Format    string `json:"format,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+}
+
+// NICConfig is a network interface of the machine. The first one
+// is used to forward the SSH port.
+type NICConfig struct {
+	Model string `json:"model,omitempty"`
+
+	// Additional options for the user-mode network backend, such
+	// as "hostfwd=tcp::8080-:80"
+	Options string `json:"options,omitempty"`
+}
+
+func loadMachineConfig(imageDir string, name string) (MachineConfig, error) {
+	filename := path.Join(imageDir, name + ".qemu.json")
+
+	var result MachineConfig
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if err.(*os.PathError) != nil {
+			return result, err
+		}
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Username == "" {
+		result.Username = "root"
+	}
+
+	if result.BaseImage == "" {
+		imgImage := filename[:len(filename)-10] + ".img"
+		qcow2Image := filename[:len(filename)-10] + ".qcow2"
+
+		if _, err := os.Stat(qcow2Image); err == nil {
+			result.BaseImage = qcow2Image
+		} else {
+			result.BaseImage = imgImage
+		}
+	} else {
+		result.BaseImage = resolvePath(imageDir, result.BaseImage)
+	}
+
+	switch result.Readiness.Method {
+	case "":
+		result.Readiness.Method = ReadinessVirtioSerial
+	case ReadinessVirtioSerial, ReadinessSSH:
+	default:
+		return result, fmt.Errorf("invalid readiness method %#v", result.Readiness.Method)
+	}
+	result.Readiness.timeout = BOOT_MAX_DELAY
+	if result.Readiness.Timeout != "" {
+		result.Readiness.timeout, err = time.ParseDuration(result.Readiness.Timeout)
+		if err != nil {
+			return result, fmt.Errorf("invalid readiness timeout: %w", err)
+		}
+	}
+
+	if result.DiskSize != "" {
+		result.diskSize, err = units.RAMInBytes(result.DiskSize)
+		if err != nil {
+			return result, fmt.Errorf("invalid disk size: %w", err)
+		}
+	}
+
+	if result.BaseImageFormat == "" {
+		if strings.HasSuffix(result.BaseImage, ".qcow2") {
+			result.BaseImageFormat = "qcow2"
+		} else {
+			result.BaseImageFormat = "raw"
+		}
+	}
+
+	// Use the image's script if there is one
+	if result.Script == "" {
+		script := path.Join(imageDir, name + ".qemu.sh")
+		if _, err := os.Stat(script); err == nil {
+			result.Script = script
+		}
+	} else {
+		result.Script = resolvePath(imageDir, result.Script)
+	}
+
+	// Machine description
+	if result.Arch == "" {
+		result.Arch = "x86_64"
+	}
+	if result.Binary == "" {
+		result.Binary = "qemu-system-" + result.Arch
+	}
+	if result.Accel == "" {
+		// KVM only runs guests of the host's architecture
+		if result.Arch == hostArch() {
+			result.Accel = "kvm"
+		} else {
+			result.Accel = "tcg"
+		}
+	}
+	if result.Machine == "" && !isPC(result.Arch) {
+		result.Machine = "virt"
+	}
+	if result.CPU == "" {
+		if result.Accel == "kvm" {
+			result.CPU = "host"
+		} else {
+			result.CPU = "max"
+		}
+	}
+	if result.Memory == 0 {
+		result.Memory = 1024
+	}
+	if result.SMP == 0 {
+		result.SMP = 2
+	}
+	if result.Firmware != "" {
+		result.Firmware = resolvePath(imageDir, result.Firmware)
+	} else if result.Arch == "aarch64" {
+		result.Firmware = AARCH64_FIRMWARE
+	}
+	for i := range result.Disks {
+		disk := &result.Disks[i]
+		if disk.File == "" {
+			return result, fmt.Errorf("disk %d has no file", i)
+		}
+		disk.File = resolvePath(imageDir, disk.File)
+		if disk.Format == "" {
+			disk.Format = "raw"
+		}
+		if disk.Interface == "" {
+			disk.Interface = "virtio"
+		}
+	}
+	if len(result.NICs) == 0 {
+		result.NICs = []NICConfig{{}}
+	}
+	for i := range result.NICs {
+		if result.NICs[i].Model == "" {
+			result.NICs[i].Model = "virtio-net-pci"
+		}
+	}
+
+	return result, nil
+}
+
+// applySettings overrides the resources of the machine with those
+// requested by the pipeline. The disk is never made smaller than
+// the image asks for.
+func (c *MachineConfig) applySettings(settings Settings) {
+	if settings.CPUs > 0 {
+		c.SMP = settings.CPUs
+	}
+	if settings.Memory > 0 {
+		// Qemu takes MiB, round up
+		c.Memory = int((settings.Memory + 1024*1024 - 1) / (1024 * 1024))
+	}
+	if settings.DiskSize > c.diskSize {
+		c.diskSize = settings.DiskSize
+	}
+}
+
+// resolvePath makes a path from a config file relative to the
+// image directory.
+func resolvePath(imageDir string, filename string) string {
+	if path.IsAbs(filename) {
+		return filename
+	}
+	return path.Join(imageDir, filename)
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// Maximum size of the console log file of a machine
+const CONSOLE_LOG_MAX_SIZE = 10 * 1024 * 1024
+
+// Amount of output kept in memory to report errors
+const CONSOLE_TAIL_SIZE = 4096
+
+// Number of lines of output reported on errors
+const CONSOLE_TAIL_LINES = 20
+
+// consoleLog records the output of Qemu, which includes the serial
+// console of the guest, to a file. The file stops growing at the
+// size limit, but the latest output is always kept in memory.
+type consoleLog struct {
+	mu        sync.Mutex
+	file      *os.File
+	written   int64
+	limit     int64
+	truncated bool
+	last      []byte
+}
+
+func newConsoleLog(filename string, limit int64) (*consoleLog, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &consoleLog{
+		file:  file,
+		limit: limit,
+	}, nil
+}
+
+func (l *consoleLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Write to the file up to the limit
+	if l.written < l.limit {
+		data := p
+		if int64(len(data)) > l.limit-l.written {
+			data = data[:l.limit-l.written]
+		}
+		n, _ := l.file.Write(data)
+		l.written += int64(n)
+	} else if !l.truncated {
+		l.file.WriteString("\n[console log truncated]\n")
+		l.truncated = true
+	}
+
+	// Keep the end in memory
+	l.last = append(l.last, p...)
+	if len(l.last) > CONSOLE_TAIL_SIZE {
+		l.last = append([]byte(nil), l.last[len(l.last)-CONSOLE_TAIL_SIZE:]...)
+	}
+
+	return len(p), nil
+}
+
+// tail returns the last lines of output.
+func (l *consoleLog) tail() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	text := strings.ReplaceAll(string(l.last), "\r\n", "\n")
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > CONSOLE_TAIL_LINES {
+		lines = lines[len(lines)-CONSOLE_TAIL_LINES:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reset forgets the output kept in memory, so that the tail only
+// has what is written next. The file keeps everything.
+func (l *consoleLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last = nil
+}
+
+func (l *consoleLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConsoleLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "console.log")
+	log, err := newConsoleLog(filename, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(log, "line %d\r\n", i)
+	}
+	log.close()
+
+	// The file stops at the limit
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "line 0\r\nline 1\r\n") {
+		t.Errorf("Unexpected start of log %q", data)
+	}
+	if !strings.HasSuffix(string(data), "\n[console log truncated]\n") {
+		t.Errorf("Expected truncation marker, got %q", data)
+	}
+	if len(data) > 100+len("\n[console log truncated]\n") {
+		t.Errorf("Log file is too big: %d bytes", len(data))
+	}
+
+	// The tail has the latest lines
+	tail := strings.Split(log.tail(), "\n")
+	if len(tail) != CONSOLE_TAIL_LINES {
+		t.Fatalf("Expected %d lines, got %d", CONSOLE_TAIL_LINES, len(tail))
+	}
+	if tail[0] != "line 30" || tail[len(tail)-1] != "line 49" {
+		t.Errorf("Unexpected tail %q", tail)
+	}
+}
+
+func TestConsoleLog_Empty(t *testing.T) {
+	log, err := newConsoleLog(filepath.Join(t.TempDir(), "console.log"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	if tail := log.tail(); tail != "" {
+		t.Errorf("Expected empty tail, got %q", tail)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// How long the machines of a failed pipeline are kept for debugging,
+// unless the session is closed earlier
+const DEBUG_TIMEOUT time.Duration = 30 * time.Minute
+
+// Port of the SSH server in the guest
+const GUEST_SSH_PORT = 22
+
+// DebugSession is a failed pipeline whose machines are kept running
+// so they can be inspected over SSH.
+type DebugSession struct {
+	ID      string
+	BuildID int64
+	Step    string
+	Address string
+	User    string
+	Expires time.Time
+}
+
+// debugSession forwards connections from a port of the host to the
+// SSH server of the machine that failed.
+type debugSession struct {
+	DebugSession
+
+	listener net.Listener
+	cancel   context.CancelFunc
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// close ends the session, disconnecting its clients.
+func (s *debugSession) close() {
+	s.once.Do(func() {
+		close(s.closed)
+		s.listener.Close()
+		s.cancel()
+	})
+}
+
+// wait blocks until the session expires or is closed.
+func (s *debugSession) wait(ctx context.Context) {
+	timer := time.NewTimer(time.Until(s.Expires))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.closed:
+	case <-ctx.Done():
+	}
+}
+
+// serve forwards the connections to the guest until the session
+// ends.
+func (s *debugSession) serve(ctx context.Context, m machine) {
+	log := logrus.WithField("debug_session", s.ID)
+	for {
+		client, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		log.WithField("remote", client.RemoteAddr().String()).Info("debug session connection")
+		go func() {
+			defer client.Close()
+			guest, err := m.dial(ctx, GUEST_SSH_PORT)
+			if err != nil {
+				log.WithError(err).Warn("couldn't connect to the guest")
+				return
+			}
+			defer guest.Close()
+			proxy(ctx, client, guest)
+		}()
+	}
+}
+
+// proxy copies data both ways until either side is done.
+func proxy(ctx context.Context, a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// startDebug keeps the machines of a spec running after a failed
+// step, and writes to the output how to connect to the machine.
+// Only the first failure starts a session.
+func (e *Engine) startDebug(spec *Spec, step *Step, m machine, settings Settings, output io.Writer) {
+	e.mu.Lock()
+	_, exists := e.debug[spec]
+	e.mu.Unlock()
+	if exists {
+		return
+	}
+	if settings.OS == "windows" {
+		fmt.Fprintln(output, "debug sessions are not supported on windows")
+		return
+	}
+
+	session, key, err := e.newDebugSession(step, m, settings)
+	if err != nil {
+		fmt.Fprintf(output, "couldn't start debug session: %v\n", err)
+		return
+	}
+	e.mu.Lock()
+	if _, exists := e.debug[spec]; exists {
+		e.mu.Unlock()
+		session.close()
+		return
+	}
+	e.debug[spec] = session
+	e.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"debug_session": session.ID,
+		"build_id":      session.BuildID,
+		"step":          step.Name,
+		"address":       session.Address,
+	}).Info("debug session started")
+
+	host, port, _ := net.SplitHostPort(session.Address)
+	fmt.Fprintf(output, "\nThe machine is kept running for debug session %s until %s, connect with:\n\n", session.ID, session.Expires.UTC().Format(time.RFC1123))
+	command := "echo " + base64.StdEncoding.EncodeToString(key) + " | base64 -d > drone-debug-key && chmod 600 drone-debug-key && "
+	if hostKey := m.hostKey(); hostKey != nil {
+		// Pin the host key, the port might be reachable by anyone
+		knownHost := knownhosts.Line([]string{knownhosts.Normalize(session.Address)}, hostKey)
+		command += "echo " + shellescape.Quote(knownHost) + " > drone-debug-known-hosts && " +
+			"ssh -i drone-debug-key -p " + port + " -o UserKnownHostsFile=drone-debug-known-hosts -o StrictHostKeyChecking=yes "
+	} else {
+		fmt.Fprintln(output, "The host key of this image is not pinned, check it before trusting the connection.")
+		command += "ssh -i drone-debug-key -p " + port + " "
+	}
+	fmt.Fprintf(output, "%s%s\n\n", command, shellescape.Quote(session.User+"@"+host))
+}
+
+// newDebugSession authorizes a new key on the machine and forwards
+// a port of the host to its SSH server. It returns the private key
+// in PEM format.
+func (e *Engine) newDebugSession(step *Step, m machine, settings Settings) (*debugSession, []byte, error) {
+	key, signer, err := newKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't generate key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't encode key: %w", err)
+	}
+
+	// The session is not bound to the step, which is over by the
+	// time it is used
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Authorize the key, for the user the steps run as
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	command := "mkdir -p ~/.ssh && chmod 700 ~/.ssh && " +
+		"echo " + shellescape.Quote(authorizedKey) + " >> ~/.ssh/authorized_keys && " +
+		"id -un"
+	var output bytes.Buffer
+	exitCode, err := m.run(ctx, command, &output)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("couldn't authorize key: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	user := strings.TrimSpace(lines[len(lines)-1])
+	if user == "" {
+		cancel()
+		return nil, nil, errors.New("couldn't get the user name")
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(e.debugBind, "0"))
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("couldn't listen: %w", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	timeout := e.debugTimeout
+	if timeout <= 0 {
+		timeout = DEBUG_TIMEOUT
+	}
+	session := &debugSession{
+		DebugSession: DebugSession{
+			ID:      newMachineID()[:8],
+			BuildID: settings.BuildID,
+			Step:    step.Name,
+			Address: net.JoinHostPort(e.debugHost, fmt.Sprint(port)),
+			User:    user,
+			Expires: time.Now().Add(timeout),
+		},
+		listener: listener,
+		cancel:   cancel,
+		closed:   make(chan struct{}),
+	}
+	go session.serve(ctx, m)
+	return session, pem.EncodeToMemory(block), nil
+}
+
+// waitDebug keeps the machines of a spec running while it has a
+// debug session, then ends the session.
+func (e *Engine) waitDebug(ctx context.Context, spec *Spec) {
+	e.mu.Lock()
+	session := e.debug[spec]
+	e.mu.Unlock()
+	if session == nil {
+		return
+	}
+	session.wait(ctx)
+
+	e.mu.Lock()
+	delete(e.debug, spec)
+	e.mu.Unlock()
+	session.close()
+	logrus.WithField("debug_session", session.ID).Info("debug session ended")
+}
+
+// DebugSessions returns the open debug sessions, the soonest to
+// expire first.
+func (e *Engine) DebugSessions() []DebugSession {
+	e.mu.Lock()
+	sessions := make([]DebugSession, 0, len(e.debug))
+	for _, session := range e.debug {
+		sessions = append(sessions, session.DebugSession)
+	}
+	e.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Expires.Before(sessions[j].Expires)
+	})
+	return sessions
+}
+
+// CloseDebugSession ends a debug session early, letting its
+// machines be destroyed. It returns false if there is no such
+// session.
+func (e *Engine) CloseDebugSession(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, session := range e.debug {
+		if session.ID == id {
+			session.close()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/runner-go/pipeline/runtime"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newDebugEngine() *Engine {
+	e, _ := newFakeEngine()
+	e.debugBind = "127.0.0.1"
+	e.debugHost = "runner.example.com"
+	e.debugTimeout = time.Minute
+	return e
+}
+
+func TestEngine_Debug(t *testing.T) {
+	e := newDebugEngine()
+	spec := &Spec{Root: "/tmp/drone-abc", Settings: Settings{Image: "debian", BuildID: 12}, Debug: true}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := e.lookup(spec)
+	fake := m.(*fakeMachine)
+	fake.fail = "make test"
+	fake.openPort = GUEST_SSH_PORT
+	_, hostSigner, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.sshKey = hostSigner.PublicKey()
+
+	step := &Step{Name: "test", Command: "make test", WorkingDir: "/tmp/drone-abc"}
+	var output bytes.Buffer
+	state, err := e.Run(nocontext, spec, step, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.ExitCode != 1 {
+		t.Fatalf("Unexpected exit code %d", state.ExitCode)
+	}
+	if !strings.Contains(output.String(), "ssh -i drone-debug-key -p ") || !strings.Contains(output.String(), "debian@runner.example.com") {
+		t.Errorf("SSH command is missing from output %q", output.String())
+	}
+	if strings.Contains(output.String(), "StrictHostKeyChecking=no") || !strings.Contains(output.String(), "UserKnownHostsFile=drone-debug-known-hosts") {
+		t.Errorf("SSH command doesn't check the host key %q", output.String())
+	}
+	if !strings.Contains(fake.commands[len(fake.commands)-1], "authorized_keys") {
+		t.Errorf("Key was not authorized, commands %q", fake.commands)
+	}
+
+	sessions := e.DebugSessions()
+	if len(sessions) != 1 || sessions[0].Step != "test" || sessions[0].BuildID != 12 {
+		t.Fatalf("Unexpected sessions %+v", sessions)
+	}
+	knownHost := knownhosts.Line([]string{knownhosts.Normalize(sessions[0].Address)}, fake.sshKey)
+	if !strings.Contains(output.String(), knownHost) {
+		t.Errorf("Host key is missing from output %q", output.String())
+	}
+
+	// Connections are forwarded to the guest's SSH server
+	_, port, _ := net.SplitHostPort(sessions[0].Address)
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Connection was not forwarded: %v", err)
+	}
+	conn.Close()
+	fake.mu.Lock()
+	if len(fake.dials) != 1 || fake.dials[0] != GUEST_SSH_PORT {
+		t.Errorf("Unexpected dials %v", fake.dials)
+	}
+	fake.mu.Unlock()
+
+	// Destroy waits for the session to be closed
+	destroyed := make(chan error, 1)
+	go func() {
+		destroyed <- e.Destroy(nocontext, spec)
+	}()
+	select {
+	case <-destroyed:
+		t.Fatal("Destroy didn't wait for the debug session")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if e.CloseDebugSession("nonexistent") {
+		t.Errorf("Closed a session that doesn't exist")
+	}
+	if !e.CloseDebugSession(sessions[0].ID) {
+		t.Fatal("Couldn't close the session")
+	}
+	select {
+	case err := <-destroyed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Destroy didn't return after the session was closed")
+	}
+	if !fake.stopped {
+		t.Errorf("Machine was not stopped")
+	}
+	if len(e.DebugSessions()) != 0 {
+		t.Errorf("Session was not forgotten")
+	}
+}
+
+func TestEngine_DebugExpires(t *testing.T) {
+	e := newDebugEngine()
+	e.debugTimeout = 100 * time.Millisecond
+	spec := &Spec{Settings: Settings{Image: "debian"}, Debug: true}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := e.lookup(spec)
+	m.(*fakeMachine).fail = "false"
+
+	e.Run(nocontext, spec, &Step{Name: "test", Command: "false"}, io.Discard)
+	if len(e.DebugSessions()) != 1 {
+		t.Fatal("Session was not started")
+	}
+	if err := e.Destroy(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.DebugSessions()) != 0 {
+		t.Errorf("Session was not forgotten")
+	}
+}
+
+func TestEngine_DebugIgnored(t *testing.T) {
+	e := newDebugEngine()
+	windows := &Spec{Settings: Settings{Image: "windows", OS: "windows"}, Debug: true}
+	ignored := &Spec{Settings: Settings{Image: "debian"}, Debug: true}
+	disabled := &Spec{Settings: Settings{Image: "debian"}}
+	for _, spec := range []*Spec{windows, ignored, disabled} {
+		if err := e.Setup(nocontext, spec); err != nil {
+			t.Fatal(err)
+		}
+		m, _ := e.lookup(spec)
+		m.(*fakeMachine).fail = "false"
+		step := &Step{Name: "test", Command: "false"}
+		if spec == ignored {
+			step.ErrPolicy = runtime.ErrIgnore
+		}
+		e.Run(nocontext, spec, step, io.Discard)
+	}
+	if len(e.DebugSessions()) != 0 {
+		t.Errorf("Unexpected sessions %+v", e.DebugSessions())
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/sirupsen/logrus"
+)
+
+// How long Destroy waits for a detached step to stop
+const DETACHED_STOP_TIMEOUT time.Duration = 30 * time.Second
+
+// Seconds a detached step gets to exit after SIGTERM, before SIGKILL
+const DETACHED_KILL_DELAY = 10
+
+// Interval between probes of a service
+const SERVICE_PROBE_INTERVAL time.Duration = time.Second
+
+// How long a service gets to become ready, unless its probe says
+const SERVICE_PROBE_TIMEOUT time.Duration = time.Minute
+
+// How long steps wait for a service to be started, on top of the
+// probe timeout
+const SERVICE_START_TIMEOUT time.Duration = time.Minute
+
+// detachedCommands run a step in the background of the guest.
+type detachedCommands struct {
+	// start launches the step and returns right away
+	start string
+
+	// follow streams the output of the step until it exits, and
+	// exits with its exit code
+	follow string
+
+	// stop terminates the step if it is still running, and
+	// prints its exit code
+	stop string
+}
+
+// detachedStep is a step running in the background of a machine.
+type detachedStep struct {
+	name    string
+	stop    string
+	machine machine
+}
+
+func (posixShell) detach(dir string, command string) (detachedCommands, error) {
+	d := shellescape.Quote(dir)
+	output := shellescape.Quote(path.Join(dir, "output"))
+	pid := shellescape.Quote(path.Join(dir, "pid"))
+	exit := shellescape.Quote(path.Join(dir, "exit"))
+
+	// The supervisor runs in its own session, so it survives the
+	// SSH session. It starts the step in another session, which
+	// can be stopped as a whole, and records its exit code.
+	supervisor := "setsid sh -c " + shellescape.Quote(command) + " >> " + output + " 2>&1 < /dev/null & " +
+		"echo $! > " + pid + "; " +
+		"wait $!; " +
+		"echo $? > " + exit + ".tmp && mv " + exit + ".tmp " + exit
+	start := "mkdir -p " + d + " && : > " + output + " && " +
+		"setsid sh -c " + shellescape.Quote(supervisor) + " > /dev/null 2>&1 < /dev/null & " +
+		"i=0; while [ ! -s " + pid + " ] && [ $i -lt 100 ]; do sleep 0.1; i=$((i+1)); done; " +
+		"[ -s " + pid + " ]"
+
+	follow := "tail -c +1 -f " + output + " & T=$!; " +
+		"while [ ! -e " + exit + " ]; do sleep 1; done; " +
+		"sleep 1; kill $T; exit $(cat " + exit + ")"
+
+	stop := "if [ ! -e " + exit + " ]; then " +
+		"kill -TERM -$(cat " + pid + ") 2>/dev/null; " +
+		"i=0; while [ ! -e " + exit + " ] && [ $i -lt " + strconv.Itoa(DETACHED_KILL_DELAY*10) + " ]; do sleep 0.1; i=$((i+1)); done; " +
+		"[ -e " + exit + " ] || kill -KILL -$(cat " + pid + ") 2>/dev/null; " +
+		"while [ ! -e " + exit + " ]; do sleep 0.1; done; " +
+		"fi; cat " + exit
+
+	return detachedCommands{start: start, follow: follow, stop: stop}, nil
+}
+
+// service is a detached step with a probe, that the steps
+// depending on it wait for.
+type service struct {
+	probe *Probe
+	ready chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func newService(probe *Probe) *service {
+	return &service{
+		probe: probe,
+		ready: make(chan struct{}),
+	}
+}
+
+// done records whether the service is ready, the first time.
+func (s *service) done(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.ready)
+	})
+}
+
+func (s *service) timeout() time.Duration {
+	if s.probe.Timeout > 0 {
+		return s.probe.Timeout
+	}
+	return SERVICE_PROBE_TIMEOUT
+}
+
+// probeService tries the probe until it succeeds or times out.
+func probeService(ctx context.Context, m machine, s *service) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+	for {
+		var err error
+		if s.probe.Port != 0 {
+			var conn net.Conn
+			conn, err = m.dial(ctx, s.probe.Port)
+			if err == nil {
+				conn.Close()
+			}
+		}
+		if err == nil && s.probe.Command != "" {
+			var exitCode int
+			exitCode, err = m.run(ctx, s.probe.Command, io.Discard)
+			if err == nil && exitCode != 0 {
+				err = fmt.Errorf("probe exited with status %d", exitCode)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(SERVICE_PROBE_INTERVAL):
+		}
+	}
+}
+
+// waitServices waits for the services a step depends on to be
+// ready.
+func (e *Engine) waitServices(ctx context.Context, spec *Spec, step *Step) error {
+	for _, name := range step.DependsOn {
+		e.mu.Lock()
+		s := e.services[spec][name]
+		e.mu.Unlock()
+		if s == nil {
+			continue
+		}
+		select {
+		case <-s.ready:
+			if s.err != nil {
+				return fmt.Errorf("service %s is not ready: %w", name, s.err)
+			}
+		case <-time.After(s.timeout() + SERVICE_START_TIMEOUT):
+			return fmt.Errorf("service %s did not start", name)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (powershellShell) detach(dir string, command string) (detachedCommands, error) {
+	return detachedCommands{}, errors.New("detached steps and services are not supported on windows")
+}
+
+// runDetached starts a step in the background, then streams its
+// output until it exits. Destroy stops it if it is still running.
+func (e *Engine) runDetached(ctx context.Context, spec *Spec, step *Step, m machine, sh shell, command string, output io.Writer) (int, error) {
+	root := spec.Root
+	if root == "" {
+		root = "/tmp"
+	}
+	dir := path.Join(root, "detached", newMachineID())
+	commands, err := sh.detach(dir, command)
+	if err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	s := e.services[spec][step.Name]
+	e.mu.Unlock()
+
+	exitCode, err := m.run(ctx, commands.start, output)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+	if err != nil {
+		err = fmt.Errorf("couldn't start detached step: %w", err)
+		if s != nil {
+			s.done(err)
+		}
+		return 0, err
+	}
+	e.mu.Lock()
+	e.detached[spec] = append(e.detached[spec], &detachedStep{
+		name:    step.Name,
+		stop:    commands.stop,
+		machine: m,
+	})
+	e.mu.Unlock()
+
+	// Let the steps depending on it know when it is ready
+	if s != nil {
+		go func() {
+			err := probeService(ctx, m, s)
+			if err != nil {
+				fmt.Fprintf(output, "service is not ready: %v\n", err)
+			}
+			s.done(err)
+		}()
+	}
+
+	return m.run(ctx, commands.follow, output)
+}
+
+// stopDetached stops detached steps, and logs how they exited.
+func stopDetached(ctx context.Context, steps []*detachedStep) {
+	for _, step := range steps {
+		log := logrus.WithField("step", step.name)
+		stopCtx, cancel := context.WithTimeout(ctx, DETACHED_STOP_TIMEOUT)
+		var output bytes.Buffer
+		_, err := step.machine.run(stopCtx, step.stop, &output)
+		cancel()
+		if err != nil {
+			log.WithError(err).Warn("couldn't stop detached step")
+			continue
+		}
+		exitCode, err := strconv.Atoi(strings.TrimSpace(output.String()))
+		if err != nil {
+			log.WithField("output", output.String()).Warn("unexpected output stopping detached step")
+			continue
+		}
+		log.WithField("exit_code", exitCode).Info("detached step exited")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runLocal runs a command the way the guest would, with sh.
+func runLocal(ctx context.Context, command string, output *bytes.Buffer) (int, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+func TestPosixDetach(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid is not available")
+	}
+	dir := filepath.Join(t.TempDir(), "detached", "abc")
+	commands, err := posixShell{}.detach(dir, "echo started; exec sleep 60")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Starting returns right away
+	var output bytes.Buffer
+	start := time.Now()
+	if code, err := runLocal(nocontext, commands.start, &output); err != nil || code != 0 {
+		t.Fatalf("Start failed: %d %v %s", code, err, output.String())
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Start didn't return right away")
+	}
+
+	// Follow the output until the step is stopped
+	type result struct {
+		code   int
+		output string
+	}
+	followed := make(chan result, 1)
+	go func() {
+		var output bytes.Buffer
+		code, _ := runLocal(nocontext, commands.follow, &output)
+		followed <- result{code, output.String()}
+	}()
+
+	output.Reset()
+	if _, err := runLocal(nocontext, commands.stop, &output); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(output.String()) != "143" {
+		t.Errorf("Expected exit code 143, got %q", output.String())
+	}
+
+	select {
+	case r := <-followed:
+		if r.code != 143 {
+			t.Errorf("Follow exited with %d", r.code)
+		}
+		if !strings.Contains(r.output, "started") {
+			t.Errorf("Output was not followed: %q", r.output)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Follow didn't return")
+	}
+
+	// Stopping again reports the same exit code
+	output.Reset()
+	runLocal(nocontext, commands.stop, &output)
+	if strings.TrimSpace(output.String()) != "143" {
+		t.Errorf("Expected exit code 143 again, got %q", output.String())
+	}
+}
+
+func TestEngine_RunDetached(t *testing.T) {
+	e, _ := newFakeEngine()
+	spec := &Spec{Root: "/tmp/drone-abc", Settings: Settings{Image: "debian"}}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	step := &Step{Name: "database", Command: "/bin/sh", Detach: true, WorkingDir: "/tmp/drone-abc"}
+	var output bytes.Buffer
+	if _, err := e.Run(nocontext, spec, step, &output); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := e.lookup(spec)
+	fake := m.(*fakeMachine)
+	if len(fake.commands) != 2 || !strings.Contains(fake.commands[0], "/tmp/drone-abc/detached/") || !strings.HasPrefix(fake.commands[1], "tail ") {
+		t.Errorf("Unexpected commands %q", fake.commands)
+	}
+
+	if err := e.Destroy(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.commands) != 3 || !strings.HasPrefix(fake.commands[2], "if [ ! -e ") {
+		t.Errorf("Detached step was not stopped, commands %q", fake.commands)
+	}
+	if len(e.detached) != 0 {
+		t.Errorf("Detached steps were not forgotten")
+	}
+}
+
+func TestEngine_RunService(t *testing.T) {
+	e, _ := newFakeEngine()
+	spec := &Spec{
+		Root:     "/tmp/drone-abc",
+		Settings: Settings{Image: "debian"},
+		Steps: []*Step{
+			{Name: "database", Detach: true, Probe: &Probe{Port: 6379}},
+			{Name: "test", DependsOn: []string{"database"}},
+		},
+	}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := e.lookup(spec)
+	fake := m.(*fakeMachine)
+	fake.openPort = 6379
+
+	go e.Run(nocontext, spec, spec.Steps[0], &bytes.Buffer{})
+	if _, err := e.Run(nocontext, spec, spec.Steps[1], &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	if len(fake.dials) == 0 || fake.dials[len(fake.dials)-1] != 6379 {
+		t.Errorf("Service was not probed, dials %v", fake.dials)
+	}
+	fake.mu.Unlock()
+
+	if err := e.Destroy(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.services) != 0 {
+		t.Errorf("Services were not forgotten")
+	}
+}
+
+func TestEngine_RunServiceNotReady(t *testing.T) {
+	e, _ := newFakeEngine()
+	spec := &Spec{
+		Root:     "/tmp/drone-abc",
+		Settings: Settings{Image: "debian"},
+		Steps: []*Step{
+			{Name: "database", Detach: true, Probe: &Probe{Port: 6379, Timeout: time.Second}},
+			{Name: "test", DependsOn: []string{"database"}},
+		},
+	}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Destroy(nocontext, spec)
+
+	go e.Run(nocontext, spec, spec.Steps[0], &bytes.Buffer{})
+	_, err := e.Run(nocontext, spec, spec.Steps[1], &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "service database is not ready") {
+		t.Errorf("Expected service not ready, got %v", err)
+	}
+}
@@ -9,15 +9,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"encoding/json"
 	"maps"
-	"math/rand"
+	"net"
 	"os"
-	"os/exec"
 	"path"
-	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/drone/runner-go/pipeline/runtime"
@@ -26,8 +23,6 @@ import (
 	"github.com/alessio/shellescape"
 )
 
-const BOOT_MAX_DELAY time.Duration = 3 * time.Minute
-
 func getMakeDirectoriesCommand(files []*File) string {
 	var command []string
 	for _, file := range files {
@@ -72,65 +67,56 @@ func getStepCommand(command string, args []string, envs map[string]string, worki
 type Opts struct {
 	ImageDir string
 	TempDir  string
-}
-
-// Machine configuration, loaded from JSON
-type MachineConfig struct {
-	Username        string `json:"username,omitempty"`
-	BaseImage       string `json:"base_image,omitempty"`
-	BaseImageFormat string `json:"base_image_format,omitempty"`
-}
 
-func loadMachineConfig(imageDir string, name string) (MachineConfig, error) {
-	filename := path.Join(imageDir, name + ".qemu.json")
+	// Where machines are recorded so they can be cleaned up after
+	// a crash, "drone-qemu-state" in TempDir by default
+	StateDir string
 
-	var result MachineConfig
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		if err.(*os.PathError) != nil {
-			return result, err
-		}
-	}
-	err = json.Unmarshal(data, &result)
-	if err != nil {
-		return result, err
-	}
+	// Resources of the host that machines can use, detected if
+	// zero. Memory is in bytes
+	Memory int64
+	CPUs   int
 
-	if result.Username == "" {
-		result.Username = "root"
-	}
+	// Ratios of the host's resources that can be committed to
+	// machines, 1 if zero
+	MemoryOvercommit float64
+	CPUOvercommit    float64
 
-	if result.BaseImage == "" {
-		imgImage := filename[:len(filename)-10] + ".img"
-		qcow2Image := filename[:len(filename)-10] + ".qcow2"
+	// Emulate the CPU if KVM is not available, which is slow
+	AllowTCG bool
 
-		if _, err := os.Stat(qcow2Image); err == nil {
-			result.BaseImage = qcow2Image
-		} else {
-			result.BaseImage = imgImage
-		}
-	}
+	// Services that guests can reach if their network policy is
+	// restricted
+	Endpoints []Endpoint
 
-	if result.BaseImageFormat == "" {
-		if strings.HasSuffix(result.BaseImage, ".qcow2") {
-			result.BaseImageFormat = "qcow2"
-		} else {
-			result.BaseImageFormat = "raw"
-		}
-	}
+	// How long the machines of a failed pipeline in debug mode are
+	// kept, DEBUG_TIMEOUT if zero
+	DebugTimeout time.Duration
 
-	return result, nil
+	// Address that debug sessions listen on, 127.0.0.1 by default,
+	// and the host shown in their SSH command, the bind address or
+	// the hostname by default
+	DebugBind string
+	DebugHost string
 }
 
 // Engine implements a pipeline engine.
 type Engine struct {
-	ImageDir            string
-	TempDir             string
-	MachineConfig       MachineConfig
-	Image               string
-	SshPort             int
-	QemuProcess         *os.Process
-	QemuProcessExitChan chan struct{}
+	ImageDir string
+	TempDir  string
+
+	driver    driver
+	admission *admission
+
+	debugTimeout time.Duration
+	debugBind    string
+	debugHost    string
+
+	mu       sync.Mutex
+	machines map[*Spec]map[string]machine
+	detached map[*Spec][]*detachedStep
+	services map[*Spec]map[string]*service
+	debug    map[*Spec]*debugSession
 }
 
 // New returns a new engine.
@@ -139,88 +125,218 @@ func New(opts Opts) (*Engine, error) {
 	if tempDir == "" {
 		tempDir = os.TempDir()
 	}
+	stateDir := opts.StateDir
+	if stateDir == "" {
+		stateDir = path.Join(tempDir, "drone-qemu-state")
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create state directory: %w", err)
+	}
+
+	// Find out how much the machines can use
+	memory, cpus, err := hostResources()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get host resources: %w", err)
+	}
+	if opts.Memory > 0 {
+		memory = int(opts.Memory / (1024 * 1024))
+	}
+	if opts.CPUs > 0 {
+		cpus = opts.CPUs
+	}
+	if opts.MemoryOvercommit > 0 {
+		memory = int(float64(memory) * opts.MemoryOvercommit)
+	}
+	if opts.CPUOvercommit > 0 {
+		cpus = int(float64(cpus) * opts.CPUOvercommit)
+	}
+	logrus.WithFields(logrus.Fields{
+		"memory": memory,
+		"cpus":   cpus,
+	}).Info("resources available to machines")
+	admission := newAdmission(memory, cpus)
+
+	// Find out where debug sessions are reached
+	debugBind := opts.DebugBind
+	if debugBind == "" {
+		debugBind = "127.0.0.1"
+	}
+	debugHost := opts.DebugHost
+	if debugHost == "" {
+		debugHost = debugBind
+		if ip := net.ParseIP(debugBind); ip != nil && ip.IsUnspecified() {
+			debugHost, err = os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("couldn't get hostname: %w", err)
+			}
+		}
+	}
 
 	return &Engine{
 		ImageDir: opts.ImageDir,
 		TempDir: tempDir,
+		driver: &qemuDriver{
+			imageDir: opts.ImageDir,
+			tempDir: tempDir,
+			stateDir: stateDir,
+			ports: newPortAllocator(),
+			admission: admission,
+			live: map[string]struct{}{},
+			pinned: map[string]int{},
+			allowTCG: opts.AllowTCG,
+			endpoints: opts.Endpoints,
+		},
+		admission: admission,
+		debugTimeout: opts.DebugTimeout,
+		debugBind: debugBind,
+		debugHost: debugHost,
+		machines: map[*Spec]map[string]machine{},
+		detached: map[*Spec][]*detachedStep{},
+		services: map[*Spec]map[string]*service{},
+		debug: map[*Spec]*debugSession{},
 	}, nil
 }
 
-func (e *Engine) ssh(ctx context.Context, command string) error {
-	logrus.WithFields(logrus.Fields{
-		"command": command,
-	}).Debug("running SSH command")
-	return exec.CommandContext(
-		ctx,
-		"ssh",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-o", "LogLevel=ERROR",
-		"-o", "ConnectTimeout=2",
-		"-i", "id_rsa",
-		"-p", strconv.Itoa(e.SshPort),
-		fmt.Sprintf("%s@localhost", e.MachineConfig.Username),
-		command,
-	).Run()
+// Cleanup kills the processes and deletes the files of machines
+// that were not shut down, for example because the runner was
+// killed.
+func (e *Engine) Cleanup(ctx context.Context) error {
+	return e.driver.cleanup(ctx)
 }
 
-func (e *Engine) sshOutput(ctx context.Context, command string, output io.Writer) error {
-	logrus.WithFields(logrus.Fields{
-		"command": command,
-	}).Debug("running SSH command")
-	cmd := exec.CommandContext(
-		ctx,
-		"ssh",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-o", "LogLevel=ERROR",
-		"-o", "ConnectTimeout=2",
-		"-i", "id_rsa",
-		"-p", strconv.Itoa(e.SshPort),
-		fmt.Sprintf("%s@localhost", e.MachineConfig.Username),
-		command,
-	)
-	cmd.Stdout = output
-	cmd.Stderr = output
-	return cmd.Run()
+// CollectVersions deletes the versions of images that were replaced
+// and are no longer used by any machine.
+func (e *Engine) CollectVersions(ctx context.Context) error {
+	return e.driver.collectVersions(ctx)
 }
 
-func writeTemp(dir string, pattern string, data []byte) (string, error) {
-	file, err := os.CreateTemp(dir, pattern)
-	defer file.Close()
-	if err != nil {
-		return "", err
+// WaitCapacity blocks until the host has room for another machine.
+func (e *Engine) WaitCapacity(ctx context.Context) error {
+	if e.admission == nil {
+		return nil
+	}
+	return e.admission.wait(ctx)
+}
+
+// machineSpecs returns the machines of the spec, or a single one
+// with its settings if it lists none.
+func machineSpecs(spec *Spec) []*MachineSpec {
+	if len(spec.Machines) == 0 {
+		return []*MachineSpec{{Settings: spec.Settings}}
+	}
+	return spec.Machines
+}
+
+// lookup returns the (first) machine running the given spec.
+func (e *Engine) lookup(spec *Spec) (machine, error) {
+	m, _, err := e.lookupMachine(spec, "")
+	return m, err
+}
+
+// lookupMachine returns the named machine of the given spec, or
+// the first one if the name is empty, with its settings.
+func (e *Engine) lookupMachine(spec *Spec, name string) (machine, Settings, error) {
+	specs := machineSpecs(spec)
+	var settings *Settings
+	if name == "" {
+		name = specs[0].Name
 	}
-	file.Write(data)
-	return file.Name(), nil
+	for _, ms := range specs {
+		if ms.Name == name {
+			settings = &ms.Settings
+			break
+		}
+	}
+	if settings == nil {
+		return nil, Settings{}, fmt.Errorf("pipeline has no machine %s", name)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	machines, ok := e.machines[spec]
+	if !ok {
+		return nil, Settings{}, errors.New("no machine is running for this pipeline")
+	}
+	return machines[name], *settings, nil
 }
 
-func (e *Engine) scpUpload(ctx context.Context, data []byte, to string) error {
-	tempFile, err := writeTemp(e.TempDir, "drone-qemu-upload-*", data)
+// bootMachines starts the machines of a spec together, connecting
+// them to a private network if there are several. If one of them
+// fails, the others are shut down.
+func (e *Engine) bootMachines(ctx context.Context, spec *Spec) (map[string]machine, error) {
+	specs := machineSpecs(spec)
+	lans := make([]*lanConfig, len(specs))
+	if len(spec.Machines) > 0 {
+		names := make([]string, len(specs))
+		for i, ms := range specs {
+			names[i] = ms.Name
+		}
+		var err error
+		lans, err = newLANConfigs(names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Reserve the resources of all the machines at once, so that
+	// pipelines don't each hold part of what they need
+	settings := make([]Settings, len(specs))
+	for i, ms := range specs {
+		settings[i] = ms.Settings
+	}
+	releases, err := e.driver.reserve(ctx, settings)
 	if err != nil {
-		return fmt.Errorf("couldn't create temporary file to upload: %w", err)
-	}
-	defer os.Remove(tempFile)
-
-	cmd := exec.CommandContext(
-		ctx,
-		"scp",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-o", "LogLevel=ERROR",
-		"-i", "id_rsa",
-		"-P", strconv.Itoa(e.SshPort),
-		tempFile,
-		fmt.Sprintf("%s@localhost:%s", e.MachineConfig.Username, to),
-	)
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+		return nil, err
+	}
+
+	machines := make([]machine, len(specs))
+	errs := make([]error, len(specs))
+	var wg sync.WaitGroup
+	for i, ms := range specs {
+		wg.Add(1)
+		go func(i int, ms *MachineSpec) {
+			defer wg.Done()
+			machines[i], errs[i] = e.driver.boot(ctx, ms.Settings, lans[i], releases[i])
+		}(i, ms)
+	}
+	wg.Wait()
+
+	for i, bootErr := range errs {
+		if bootErr != nil && err == nil {
+			err = bootErr
+			if specs[i].Name != "" {
+				err = fmt.Errorf("machine %s: %w", specs[i].Name, bootErr)
+			}
+		}
+	}
+	if err != nil {
+		for _, m := range machines {
+			if m != nil {
+				m.shutdown(ctx)
+			}
+		}
+		return nil, err
+	}
+
+	group := make(map[string]machine, len(specs))
+	for i, ms := range specs {
+		group[ms.Name] = machines[i]
+	}
+	return group, nil
 }
 
-func (e *Engine) uploadFiles(ctx context.Context, files []*File) error {
+func uploadFiles(ctx context.Context, m machine, sh shell, files []*File) error {
+	if len(files) == 0 {
+		return nil
+	}
+
 	// Make directories for uploaded files
-	makeDirectoryCommand := getMakeDirectoriesCommand(files)
-	if err := e.ssh(ctx, makeDirectoryCommand); err != nil {
+	makeDirectoryCommand := sh.makeDirectories(files)
+	exitCode, err := m.run(ctx, makeDirectoryCommand, io.Discard)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to create directories for uploaded files: %w", err)
 	}
 
@@ -231,7 +347,7 @@ func (e *Engine) uploadFiles(ctx context.Context, files []*File) error {
 		}
 
 		// Upload
-		err := e.scpUpload(ctx, file.Data, file.Path)
+		err := m.upload(ctx, sh.remoteFile(file))
 		if err != nil {
 			return fmt.Errorf("sftp failed: %w", err)
 		}
@@ -244,131 +360,91 @@ func (e *Engine) uploadFiles(ctx context.Context, files []*File) error {
 func (e *Engine) Setup(ctx context.Context, specv runtime.Spec) error {
 	spec := specv.(*Spec)
 
-	// Load configuration
-	var err error
-	e.MachineConfig, err = loadMachineConfig(e.ImageDir, spec.Settings.Image)
-	if err != nil {
-		return fmt.Errorf("error loading machine config JSON: %w", err)
+	e.mu.Lock()
+	_, exists := e.machines[spec]
+	e.mu.Unlock()
+	if exists {
+		return errors.New("a machine is already running for this pipeline")
 	}
 
-	// Pick random port
-	e.SshPort = rand.Intn(65536 - 1025) + 1025
-
-	// Pick random image name
-	e.Image = path.Join(e.TempDir, fmt.Sprintf("drone-qemu-%d.qcow2", rand.Int()))
-
-	// Create the temporary image
-	logrus.WithFields(logrus.Fields{
-		"image": e.Image,
-	}).Info("creating image")
-	err = exec.CommandContext(
-		ctx,
-		"qemu-img", "create",
-		"-f", "qcow2",
-		"-b", e.MachineConfig.BaseImage,
-		"-F", e.MachineConfig.BaseImageFormat,
-		e.Image,
-	).Run()
+	machines, err := e.bootMachines(ctx, spec)
 	if err != nil {
-		return fmt.Errorf("qemu-img failed: %w", err)
+		return err
 	}
 
-	// Start Qemu
-	logrus.Info("starting qemu")
-	cmd := exec.CommandContext(
-		ctx,
-		path.Join(e.ImageDir, spec.Settings.Image + ".qemu.sh"),
-	)
-	cmd.Env = append(cmd.Env, "QEMU_IMAGE=" + e.Image)
-	cmd.Env = append(cmd.Env, "QEMU_SSH_PORT=" + strconv.Itoa(e.SshPort))
-	//cmd.Stdout = os.Stdout // DEBUG
-	//cmd.Stderr = os.Stderr // DEBUG
-	err = cmd.Start()
-	if err != nil {
-		os.Remove(e.Image)
-		e.Image = ""
-		return fmt.Errorf("qemu process failed to start: %w", err)
-	}
-	e.QemuProcess = cmd.Process
-	e.QemuProcessExitChan = make(chan struct{})
-	go func() {
-		cmd.Process.Wait()
-		close(e.QemuProcessExitChan)
-	}()
-
-	// Try to connect via SSH until it succeeds
-	bootChannel := make(chan bool)
-	start := time.Now()
-	go func() {
-		for time.Since(start) <= BOOT_MAX_DELAY {
-			// Wait for Qemu to exit or 5 seconds
-			select {
-			case _, running := <- e.QemuProcessExitChan:
-				if !running {
-					return
-				}
-			case _ = <- time.After(5 * time.Second):
-			}
-
-			err := e.ssh(ctx, "true")
-			if err == nil {
-				bootChannel <- true
-				return
-			}
-			logrus.Infof("connection failing: %v", err)
-		}
-		bootChannel <- false
-	}()
-
-	select {
-	case <-e.QemuProcessExitChan:
-		return fmt.Errorf("qemu process died")
-	case booted := <- bootChannel:
-		if booted {
-			logrus.WithFields(logrus.Fields{
-				"duration": time.Since(start),
-			}).Info("machine has started")
-		} else {
-			return errors.New("machine did not come online")
+	// Register the machines so that Run and Destroy can find them,
+	// and the services so that steps can wait for them
+	services := map[string]*service{}
+	for _, step := range spec.Steps {
+		if step.Detach && step.Probe != nil {
+			services[step.Name] = newService(step.Probe)
 		}
 	}
-
-	// Upload files
-	err = e.uploadFiles(ctx, spec.Files)
-	if err != nil {
-		return err
+	e.mu.Lock()
+	e.machines[spec] = machines
+	e.services[spec] = services
+	e.mu.Unlock()
+
+	// Upload files to every machine
+	for _, ms := range machineSpecs(spec) {
+		err = uploadFiles(ctx, machines[ms.Name], getShell(ms.Settings.OS), spec.Files)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// Destroy the pipeline environment.
+// Destroy the pipeline environment. If a step failed in debug mode,
+// this waits for the debug session to end first.
 func (e *Engine) Destroy(ctx context.Context, specv runtime.Spec) error {
-	// Stop the Qemu process
-	if e.QemuProcess != nil {
-		e.QemuProcess.Signal(syscall.SIGINT)
-		e.QemuProcess.Wait()
-	}
+	spec := specv.(*Spec)
 
-	// Delete the temporary image
-	if e.Image != "" {
-		os.Remove(e.Image)
+	e.waitDebug(ctx, spec)
+
+	e.mu.Lock()
+	machines, ok := e.machines[spec]
+	delete(e.machines, spec)
+	detached := e.detached[spec]
+	delete(e.detached, spec)
+	services := e.services[spec]
+	delete(e.services, spec)
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	for _, s := range services {
+		s.done(errors.New("pipeline ended"))
 	}
 
-	return nil
+	// Stop the steps still running in the background
+	stopDetached(ctx, detached)
+
+	var err error
+	for _, m := range machines {
+		if shutdownErr := m.shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
 }
 
 // Run runs the pipeline step.
 func (e *Engine) Run(ctx context.Context, specv runtime.Spec, stepv runtime.Step, output io.Writer) (*runtime.State, error) {
-	// spec := specv.(*Spec)
+	spec := specv.(*Spec)
 	step := stepv.(*Step)
 
-	// Upload files
-	err := e.uploadFiles(ctx, step.Files)
+	m, settings, err := e.lookupMachine(spec, step.Machine)
 	if err != nil {
 		return nil, err
 	}
 
+	// Wait for the services the step needs
+	if err := e.waitServices(ctx, spec, step); err != nil {
+		return nil, err
+	}
+
 	// Add secrets to env
 	envs := step.Envs
 	if len(step.Secrets) > 0 {
@@ -379,24 +455,38 @@ func (e *Engine) Run(ctx context.Context, specv runtime.Spec, stepv runtime.Step
 		}
 	}
 
-	// Build full command
-	fullCommand := getStepCommand(
-		step.Command,
-		step.Args,
-		envs,
-		step.WorkingDir,
-	)
+	// Build full command, in the guest's shell
+	sh := getShell(settings.OS)
+	fullCommand, stepFiles := sh.step(spec.Root, step, envs)
+
+	// Upload files
+	files := step.Files
+	if len(stepFiles) > 0 {
+		files = append(append([]*File(nil), step.Files...), stepFiles...)
+	}
+	err = uploadFiles(ctx, m, sh, files)
+	if err != nil {
+		return nil, err
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"command": fullCommand,
 	}).Debug("running command")
 
 	// SSH and run command
-	err = e.sshOutput(ctx, fullCommand, output)
-
-	exitCode := 0
+	var exitCode int
+	if step.Detach {
+		exitCode, err = e.runDetached(ctx, spec, step, m, sh, fullCommand, output)
+	} else {
+		exitCode, err = m.run(ctx, fullCommand, output)
+	}
 	if err != nil {
-		exit_err := err.(*exec.ExitError)
-		exitCode = exit_err.ExitCode()
+		return nil, err
+	}
+
+	// Keep the machines for debugging if the pipeline fails
+	if exitCode != 0 && spec.Debug && step.ErrPolicy != runtime.ErrIgnore {
+		e.startDebug(spec, step, m, settings, output)
 	}
 
 	return &runtime.State{
@@ -405,7 +495,8 @@ func (e *Engine) Run(ctx context.Context, specv runtime.Spec, stepv runtime.Step
 	}, nil
 }
 
-// Ping pings the underlying runtime to verify connectivity.
+// Ping checks that the engine can start machines. The error is a
+// *HealthError listing the checks that failed.
 func (e *Engine) Ping(ctx context.Context) error {
-	return nil
+	return e.driver.ping(ctx)
 }
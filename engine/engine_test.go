@@ -1,9 +1,23 @@
 package engine
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+
+	"golang.org/x/crypto/ssh"
 )
 
+var nocontext = context.Background()
+
 func Test_makeDirectories(t *testing.T) {
 	result := getMakeDirectoriesCommand([]*File{
 		&File{
@@ -53,3 +67,319 @@ func Test_stepCommand(t *testing.T) {
 		t.Errorf("%#v != %#v", result2, expected2a)
 	}
 }
+
+// fakeDriver boots fakeMachines instead of virtual machines.
+type fakeDriver struct {
+	mu     sync.Mutex
+	booted int
+
+	// Reserves the memory and CPUs of the settings
+	admission *admission
+}
+
+func (d *fakeDriver) reserve(ctx context.Context, settings []Settings) ([]func(), error) {
+	memory := make([]int, len(settings))
+	cpus := make([]int, len(settings))
+	for i, s := range settings {
+		memory[i] = int(s.Memory / (1024 * 1024))
+		cpus[i] = s.CPUs
+	}
+	return d.admission.acquireGroup(ctx, memory, cpus)
+}
+
+func (d *fakeDriver) boot(ctx context.Context, settings Settings, lan *lanConfig, release func()) (machine, error) {
+	d.mu.Lock()
+	d.booted++
+	d.mu.Unlock()
+	return &fakeMachine{image: settings.Image, lan: lan, release: release}, nil
+}
+
+func (d *fakeDriver) cleanup(ctx context.Context) error {
+	return nil
+}
+
+func (d *fakeDriver) collectVersions(ctx context.Context) error {
+	return nil
+}
+
+func (d *fakeDriver) ping(ctx context.Context) error {
+	return nil
+}
+
+// fakeMachine records the commands and uploads it receives.
+type fakeMachine struct {
+	image   string
+	lan     *lanConfig
+	release func()
+
+	mu       sync.Mutex
+	commands []string
+	uploads  []string
+	dials    []int
+	openPort int
+	sshKey   ssh.PublicKey
+	stopped  bool
+
+	// Commands containing this exit with status 1
+	fail string
+}
+
+func (m *fakeMachine) run(ctx context.Context, command string, output io.Writer) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return 0, errors.New("machine is stopped")
+	}
+	m.commands = append(m.commands, command)
+	fmt.Fprint(output, m.image)
+	if m.fail != "" && strings.Contains(command, m.fail) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (m *fakeMachine) upload(ctx context.Context, file *File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads = append(m.uploads, file.Path)
+	return nil
+}
+
+// dial returns a connection that the other end closes right away.
+func (m *fakeMachine) dial(ctx context.Context, port int) (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dials = append(m.dials, port)
+	if port != m.openPort {
+		return nil, errors.New("connection refused")
+	}
+	conn, guest := net.Pipe()
+	guest.Close()
+	return conn, nil
+}
+
+func (m *fakeMachine) hostKey() ssh.PublicKey {
+	return m.sshKey
+}
+
+func (m *fakeMachine) export(ctx context.Context, filename string) error {
+	return os.WriteFile(filename, []byte("exported "+m.image), 0644)
+}
+
+func (m *fakeMachine) shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	m.release()
+	return nil
+}
+
+func newFakeEngine() (*Engine, *fakeDriver) {
+	d := &fakeDriver{admission: newAdmission(64*1024, 64)}
+	return &Engine{
+		driver:   d,
+		machines: map[*Spec]map[string]machine{},
+		detached: map[*Spec][]*detachedStep{},
+		services: map[*Spec]map[string]*service{},
+		debug:    map[*Spec]*debugSession{},
+	}, d
+}
+
+func TestEngine_ConcurrentSpecs(t *testing.T) {
+	e, d := newFakeEngine()
+
+	const count = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			image := fmt.Sprintf("image-%d", i)
+			spec := &Spec{
+				Settings: Settings{Image: image},
+				Files:    []*File{{Path: "/tmp/" + image}},
+			}
+			step := &Step{Command: "/bin/sh", WorkingDir: "/tmp"}
+			if err := e.Setup(nocontext, spec); err != nil {
+				errs <- err
+				return
+			}
+			m, err := e.lookup(spec)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < 10; j++ {
+				var buf bytes.Buffer
+				state, err := e.Run(nocontext, spec, step, &buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if state.ExitCode != 0 || buf.String() != image {
+					errs <- fmt.Errorf("step for %s ran on %s", image, buf.String())
+					return
+				}
+			}
+			if err := e.Destroy(nocontext, spec); err != nil {
+				errs <- err
+				return
+			}
+			fake := m.(*fakeMachine)
+			if !fake.stopped {
+				errs <- fmt.Errorf("machine for %s was not stopped", image)
+			}
+			if len(fake.uploads) != 1 || fake.uploads[0] != "/tmp/"+image {
+				errs <- fmt.Errorf("unexpected uploads for %s: %v", image, fake.uploads)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if d.booted != count {
+		t.Errorf("Expected %d machines booted, got %d", count, d.booted)
+	}
+	if len(e.machines) != 0 {
+		t.Errorf("Expected no machines left, got %d", len(e.machines))
+	}
+}
+
+func TestEngine_RunWithoutSetup(t *testing.T) {
+	e, _ := newFakeEngine()
+	_, err := e.Run(nocontext, &Spec{}, &Step{}, io.Discard)
+	if err == nil {
+		t.Errorf("Expected error running a step without a machine")
+	}
+}
+
+func TestEngine_SetupTwice(t *testing.T) {
+	e, _ := newFakeEngine()
+	spec := &Spec{}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Destroy(nocontext, spec)
+	if err := e.Setup(nocontext, spec); err == nil {
+		t.Errorf("Expected error setting up the same spec twice")
+	}
+}
+
+func TestEngine_Export(t *testing.T) {
+	e, _ := newFakeEngine()
+	e.ImageDir = t.TempDir()
+	os.WriteFile(filepath.Join(e.ImageDir, "base.qemu.json"), []byte(`{"username": "debian", "memory": 2048}`), 0644)
+	os.WriteFile(filepath.Join(e.ImageDir, "base.qemu.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	spec := &Spec{Settings: Settings{Image: "base"}}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Destroy(nocontext, spec)
+	if err := e.Export(nocontext, spec, "base"); err == nil {
+		t.Errorf("Expected error when overwriting the parent image")
+	}
+	if err := e.Export(nocontext, spec, "custom"); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadMachineConfig(e.ImageDir, "custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(config.BaseImage)
+	if string(data) != "exported base" {
+		t.Errorf("Unexpected image %q", data)
+	}
+	if config.Parent != "base" || config.Username != "debian" || config.Memory != 2048 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if config.Script != filepath.Join(e.ImageDir, "base.qemu.sh") {
+		t.Errorf("Expected the parent's script, got %q", config.Script)
+	}
+	if config.BaseImage != filepath.Join(e.ImageDir, "versions", config.SHA256+".qcow2") || config.BaseImageFormat != "qcow2" || len(config.SHA256) != 64 {
+		t.Errorf("Unexpected base image %q %q %q", config.BaseImage, config.BaseImageFormat, config.SHA256)
+	}
+}
+
+func TestEngine_MachinesTooLarge(t *testing.T) {
+	e, d := newFakeEngine()
+	d.admission = newAdmission(4096, 4)
+	spec := &Spec{
+		Machines: []*MachineSpec{
+			{Name: "client", Settings: Settings{Image: "debian", Memory: 3 << 30, CPUs: 1}},
+			{Name: "server", Settings: Settings{Image: "fedora", Memory: 3 << 30, CPUs: 1}},
+		},
+	}
+	err := e.Setup(nocontext, spec)
+	if err == nil || !strings.Contains(err.Error(), "more than the runner has") {
+		t.Fatalf("Expected machines to be refused, got %v", err)
+	}
+	if d.booted != 0 {
+		t.Errorf("Machines were booted")
+	}
+}
+
+func TestEngine_MultipleMachines(t *testing.T) {
+	e, d := newFakeEngine()
+	spec := &Spec{
+		Files: []*File{{Path: "/tmp/drone-abc/opt/test"}},
+		Machines: []*MachineSpec{
+			{Name: "client", Settings: Settings{Image: "debian"}},
+			{Name: "server", Settings: Settings{Image: "fedora"}},
+		},
+	}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	if d.booted != 2 {
+		t.Fatalf("Expected 2 machines booted, got %d", d.booted)
+	}
+
+	for _, test := range []struct {
+		machine string
+		image   string
+	}{
+		{"", "debian"},
+		{"client", "debian"},
+		{"server", "fedora"},
+	} {
+		var buf bytes.Buffer
+		step := &Step{Command: "/bin/sh", WorkingDir: "/tmp", Machine: test.machine}
+		if _, err := e.Run(nocontext, spec, step, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.image {
+			t.Errorf("Step for %q ran on %s", test.machine, buf.String())
+		}
+	}
+	_, err := e.Run(nocontext, spec, &Step{Machine: "database"}, io.Discard)
+	if err == nil || err.Error() != "pipeline has no machine database" {
+		t.Errorf("Unexpected error for unknown machine: %v", err)
+	}
+
+	e.mu.Lock()
+	client := e.machines[spec]["client"].(*fakeMachine)
+	server := e.machines[spec]["server"].(*fakeMachine)
+	e.mu.Unlock()
+	if client.lan == nil || server.lan == nil || client.lan.Group != server.lan.Group {
+		t.Fatalf("Machines are not on the same network")
+	}
+	if client.lan.Name != "client" || server.lan.Address != "10.0.3.11" {
+		t.Errorf("Unexpected network configuration %+v", server.lan)
+	}
+	if len(client.uploads) != 1 || len(server.uploads) != 1 {
+		t.Errorf("Files were not uploaded to every machine")
+	}
+
+	if err := e.Destroy(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	if !client.stopped || !server.stopped {
+		t.Errorf("Machines were not stopped")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long the guest gets to shut down before its disk is exported
+const EXPORT_SHUTDOWN_TIMEOUT time.Duration = 2 * time.Minute
+
+// export shuts the guest down cleanly, then writes its disk as a
+// standalone qcow2 image.
+func (m *qemuMachine) export(ctx context.Context, filename string) error {
+	// Have cloud-init run again on the next boot, replacing the
+	// host key and password of this build, and forget its key
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(m.clientKey)))
+	command := "sudo cloud-init clean --logs && " +
+		"sed -i " + shellescape.Quote("\\|^"+authorizedKey+"$|d") + " ~/.ssh/authorized_keys"
+	var cleanOutput bytes.Buffer
+	exitCode, cleanErr := m.transport.run(ctx, command, &cleanOutput)
+	if cleanErr == nil && exitCode != 0 {
+		cleanErr = fmt.Errorf("exit status %d: %s", exitCode, strings.TrimSpace(cleanOutput.String()))
+	}
+	if cleanErr != nil {
+		logrus.WithError(cleanErr).Warn("couldn't clean up cloud-init, the image keeps the build's keys")
+	}
+
+	// Flush what we can before asking for the shutdown
+	m.transport.run(ctx, "sync", io.Discard)
+	m.transport.close()
+	m.transport = nil
+
+	client := m.getQMP()
+	if client == nil {
+		return errors.New("can't shut down the machine without QMP")
+	}
+	logrus.Info("shutting down machine")
+	qmpCtx, cancel := context.WithTimeout(ctx, QMP_COMMAND_TIMEOUT)
+	_, err := client.execute(qmpCtx, "system_powerdown", nil)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("couldn't shut down the machine: %w", err)
+	}
+	if !m.waitExit(EXPORT_SHUTDOWN_TIMEOUT) {
+		return errors.New("machine did not shut down")
+	}
+
+	logrus.WithField("image", filename).Info("exporting image")
+	temp := path.Join(path.Dir(filename), "."+path.Base(filename)+".tmp")
+	output, err := exec.CommandContext(
+		ctx,
+		"qemu-img", "convert",
+		"-f", "qcow2",
+		"-O", "qcow2",
+		m.image,
+		temp,
+	).CombinedOutput()
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("qemu-img convert failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.Rename(temp, filename)
+}
+
+// Export shuts down the (first) machine of a spec cleanly, and saves its disk
+// as a new image in the image directory, built from the spec's image.
+// The machine can't be used afterwards, but still has to be destroyed.
+func (e *Engine) Export(ctx context.Context, spec *Spec, name string) error {
+	m, settings, err := e.lookupMachine(spec, "")
+	if err != nil {
+		return err
+	}
+	parent := settings.Image
+	if name == parent || strings.ContainsAny(name, "/\\") || name == "" {
+		return fmt.Errorf("invalid image name %#v", name)
+	}
+
+	// Start from the parent's configuration, as written
+	var config MachineConfig
+	data, err := os.ReadFile(path.Join(e.ImageDir, parent+".qemu.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	if config.Script == "" {
+		if _, err := os.Stat(path.Join(e.ImageDir, parent+".qemu.sh")); err == nil {
+			config.Script = parent + ".qemu.sh"
+		}
+	}
+
+	config.Parent = parent
+	config.BaseImageFormat = "qcow2"
+	exported := path.Join(e.ImageDir, VERSIONS_DIR, "."+name+".export")
+	if err := os.MkdirAll(path.Dir(exported), 0755); err != nil {
+		return err
+	}
+	if err := m.export(ctx, exported); err != nil {
+		return err
+	}
+	config.SHA256, err = fileChecksum(exported)
+	if err != nil {
+		os.Remove(exported)
+		return err
+	}
+	config.BaseImage, err = storeVersion(e.ImageDir, exported, config.SHA256, config.BaseImageFormat)
+	if err != nil {
+		os.Remove(exported)
+		return err
+	}
+	return writeImageConfig(e.ImageDir, name, config)
+}
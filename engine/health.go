@@ -0,0 +1,182 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Free space needed in the temporary directory for overlays
+const MIN_FREE_SPACE = 1024 * 1024 * 1024
+
+const CHECK_COMMAND_TIMEOUT time.Duration = 10 * time.Second
+
+// Names of the health checks
+const (
+	CheckQemuImg  = "qemu-img"
+	CheckQemu     = "qemu"
+	CheckImages   = "images"
+	CheckKVM      = "kvm"
+	CheckTempDir  = "temp-dir"
+	CheckStateDir = "state-dir"
+	CheckNetwork  = "network"
+)
+
+// CheckError is a failed health check.
+type CheckError struct {
+	Check string
+	Err   error
+}
+
+func (e *CheckError) Error() string {
+	return e.Check + ": " + e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// HealthError is returned by Ping when some checks failed.
+type HealthError struct {
+	Checks []*CheckError
+}
+
+func (e *HealthError) Error() string {
+	messages := make([]string, len(e.Checks))
+	for i, check := range e.Checks {
+		messages[i] = check.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// checkCommand makes sure a program can be run.
+func checkCommand(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, CHECK_COMMAND_TIMEOUT)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		if len(output) > 0 {
+			return fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(string(output)))
+		}
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+// kvmAvailable returns an error if /dev/kvm can't be used.
+func kvmAvailable() error {
+	file, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// checkWritable makes sure files can be created in a directory,
+// and that it has at least minFree bytes available.
+func checkWritable(dir string, minFree uint64) error {
+	file, err := os.CreateTemp(dir, ".drone-qemu-check-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	if minFree > 0 {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return err
+		}
+		free := stat.Bavail * uint64(stat.Bsize)
+		if free < minFree {
+			return fmt.Errorf("only %d MiB free", free/(1024*1024))
+		}
+	}
+	return nil
+}
+
+// ping checks that machines can be started.
+func (d *qemuDriver) ping(ctx context.Context) error {
+	var failed []*CheckError
+	fail := func(check string, err error) {
+		failed = append(failed, &CheckError{Check: check, Err: err})
+	}
+
+	if err := checkCommand(ctx, "qemu-img", "--version"); err != nil {
+		fail(CheckQemuImg, err)
+	}
+
+	// Find the valid images, and what they need
+	names, err := ListImages(d.imageDir)
+	if err != nil {
+		fail(CheckImages, err)
+	}
+	binaries := map[string]bool{}
+	needKVM := false
+	valid := 0
+	for _, name := range names {
+		config, err := loadMachineConfig(d.imageDir, name)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(config.BaseImage); err != nil {
+			continue
+		}
+		valid++
+		if config.Script == "" {
+			binaries[config.Binary] = true
+			if config.Accel == "kvm" {
+				needKVM = true
+			}
+		}
+	}
+	if err == nil && valid == 0 {
+		fail(CheckImages, errors.New("no valid image in " + d.imageDir))
+	}
+
+	binaryNames := make([]string, 0, len(binaries))
+	for binary := range binaries {
+		binaryNames = append(binaryNames, binary)
+	}
+	sort.Strings(binaryNames)
+	for _, binary := range binaryNames {
+		if err := checkCommand(ctx, binary, "--version"); err != nil {
+			fail(CheckQemu, err)
+		}
+	}
+
+	if needKVM && !d.allowTCG {
+		if err := kvmAvailable(); err != nil {
+			fail(CheckKVM, err)
+		}
+	}
+
+	// Netcat forwards the connections to endpoints
+	if len(d.endpoints) > 0 {
+		if _, err := exec.LookPath("nc"); err != nil {
+			fail(CheckNetwork, err)
+		}
+	}
+
+	if err := checkWritable(d.tempDir, MIN_FREE_SPACE); err != nil {
+		fail(CheckTempDir, err)
+	}
+	if err := checkWritable(d.stateDir, 0); err != nil {
+		fail(CheckStateDir, err)
+	}
+
+	if len(failed) > 0 {
+		return &HealthError{Checks: failed}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failedChecks returns the names of the checks that failed.
+func failedChecks(t *testing.T, err error) map[string]bool {
+	failed := map[string]bool{}
+	if err == nil {
+		return failed
+	}
+	var health *HealthError
+	if !errors.As(err, &health) {
+		t.Fatalf("Expected a HealthError, got %v", err)
+	}
+	for _, check := range health.Checks {
+		failed[check.Check] = true
+	}
+	return failed
+}
+
+func TestPing_NoImages(t *testing.T) {
+	d := &qemuDriver{
+		imageDir: t.TempDir(),
+		tempDir:  t.TempDir(),
+		stateDir: t.TempDir(),
+	}
+	failed := failedChecks(t, d.ping(nocontext))
+	if !failed[CheckImages] {
+		t.Errorf("Expected images check to fail")
+	}
+	if failed[CheckTempDir] || failed[CheckStateDir] {
+		t.Errorf("Unexpected failure of directory checks")
+	}
+}
+
+func TestPing_MissingBinary(t *testing.T) {
+	imageDir := t.TempDir()
+	os.WriteFile(filepath.Join(imageDir, "test.qemu.json"), []byte(`{
+		"binary": "/nonexistent/qemu-system-x86_64",
+		"accel": "tcg"
+	}`), 0644)
+	os.WriteFile(filepath.Join(imageDir, "test.qcow2"), nil, 0644)
+
+	// Not an image: no base image
+	os.WriteFile(filepath.Join(imageDir, "other.qemu.json"), []byte(`{}`), 0644)
+
+	d := &qemuDriver{
+		imageDir: imageDir,
+		tempDir:  t.TempDir(),
+		stateDir: filepath.Join(t.TempDir(), "missing"),
+	}
+	failed := failedChecks(t, d.ping(nocontext))
+	if failed[CheckImages] {
+		t.Errorf("Unexpected failure of images check")
+	}
+	if !failed[CheckQemu] {
+		t.Errorf("Expected qemu check to fail")
+	}
+	if failed[CheckKVM] {
+		t.Errorf("Unexpected KVM check for an image using TCG")
+	}
+	if !failed[CheckStateDir] {
+		t.Errorf("Expected state directory check to fail")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkWritable(dir, 1); err != nil {
+		t.Error(err)
+	}
+	if err := checkWritable(dir, 1<<62); err == nil {
+		t.Errorf("Expected error for insufficient free space")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Check left %d files behind", len(entries))
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ImageInfo describes an image of the image directory.
+type ImageInfo struct {
+	Name        string        `json:"name"`
+	Config      MachineConfig `json:"config"`
+	Format      string        `json:"format,omitempty"`
+	VirtualSize int64         `json:"virtual_size,omitempty"`
+	ActualSize  int64         `json:"actual_size,omitempty"`
+	BackingFile string        `json:"backing_file,omitempty"`
+	Checksum    string        `json:"sha256,omitempty"`
+}
+
+// LaunchInfo is how a machine is started for an image.
+type LaunchInfo struct {
+	Script  string   `json:"script,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Environ []string `json:"environ,omitempty"`
+}
+
+// qemuImgInfo is the output of "qemu-img info --output=json".
+type qemuImgInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	ActualSize  int64  `json:"actual-size"`
+	BackingFile string `json:"backing-filename"`
+}
+
+// ListImages returns the names of the images in the image
+// directory, which have a .qemu.json file.
+func ListImages(imageDir string) ([]string, error) {
+	entries, err := os.ReadDir(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".qemu.json") {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".qemu.json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readImageInfo(ctx context.Context, filename string) (*qemuImgInfo, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "qemu-img", "info", "--output=json", filename)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("qemu-img info failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("qemu-img info failed: %w", err)
+	}
+	var info qemuImgInfo
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func fileChecksum(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// InspectImage returns the configuration and disk information of an
+// image. Computing the checksum reads the whole base image.
+func InspectImage(ctx context.Context, imageDir string, name string, checksum bool) (*ImageInfo, error) {
+	config, err := loadMachineConfig(imageDir, name)
+	if err != nil {
+		return nil, err
+	}
+	result := &ImageInfo{
+		Name:   name,
+		Config: config,
+	}
+
+	info, err := readImageInfo(ctx, config.BaseImage)
+	if err != nil {
+		return result, err
+	}
+	result.Format = info.Format
+	result.VirtualSize = info.VirtualSize
+	result.ActualSize = info.ActualSize
+	result.BackingFile = info.BackingFile
+
+	if checksum {
+		result.Checksum, err = fileChecksum(config.BaseImage)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// ImageLaunch returns how a machine would be started for an image,
+// with placeholders for the per-build parameters.
+func ImageLaunch(imageDir string, name string, settings Settings) (*LaunchInfo, error) {
+	config, err := loadMachineConfig(imageDir, name)
+	if err != nil {
+		return nil, err
+	}
+	config.applySettings(settings)
+	params := launchParams{
+		Image:       "<image>",
+		SeedImage:   "<seed-image>",
+		SSHPort:     0,
+		QMPSocket:   "<qmp-socket>",
+		ReadySocket: "<ready-socket>",
+	}
+	if config.Script != "" {
+		return &LaunchInfo{
+			Script:  config.Script,
+			Environ: params.environ(config),
+		}, nil
+	}
+	return &LaunchInfo{
+		Command: qemuCommand(config, params),
+	}, nil
+}
+
+// ValidateImages checks every image of the image directory, and
+// returns the problems found for each image.
+func ValidateImages(ctx context.Context, imageDir string) (map[string][]error, error) {
+	entries, err := os.ReadDir(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string][]error{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), ".qemu.json") {
+			name := strings.TrimSuffix(entry.Name(), ".qemu.json")
+			result[name] = validateImage(ctx, imageDir, name)
+		} else if strings.HasSuffix(entry.Name(), ".qemu.sh") {
+			name := strings.TrimSuffix(entry.Name(), ".qemu.sh")
+			if _, err := os.Stat(path.Join(imageDir, name+".qemu.json")); os.IsNotExist(err) {
+				result[name] = []error{errors.New("script has no .qemu.json file")}
+			}
+		}
+	}
+	return result, nil
+}
+
+func validateImage(ctx context.Context, imageDir string, name string) []error {
+	var problems []error
+
+	// Look for unknown fields, which are ignored otherwise
+	data, err := os.ReadFile(path.Join(imageDir, name+".qemu.json"))
+	if err != nil {
+		return []error{err}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var strict MachineConfig
+	if err := decoder.Decode(&strict); err != nil {
+		problems = append(problems, fmt.Errorf("invalid .qemu.json: %w", err))
+	}
+
+	config, err := loadMachineConfig(imageDir, name)
+	if err != nil {
+		return append(problems, err)
+	}
+
+	// Check the base image
+	if _, err := os.Stat(config.BaseImage); err != nil {
+		problems = append(problems, fmt.Errorf("missing base image: %w", err))
+	} else if info, err := readImageInfo(ctx, config.BaseImage); err != nil {
+		problems = append(problems, err)
+	} else if info.Format != config.BaseImageFormat {
+		problems = append(problems, fmt.Errorf(
+			"base image is %s, not %s", info.Format, config.BaseImageFormat,
+		))
+	}
+
+	// Check the script
+	if config.Script != "" {
+		info, err := os.Stat(config.Script)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("missing script: %w", err))
+		} else if info.Mode().Perm()&0111 == 0 {
+			problems = append(problems, fmt.Errorf("script %s is not executable", config.Script))
+		}
+	}
+
+	// Check the additional disks
+	for _, disk := range config.Disks {
+		if _, err := os.Stat(disk.File); err != nil {
+			problems = append(problems, fmt.Errorf("missing disk: %w", err))
+		}
+	}
+	if config.Firmware != "" {
+		if _, err := os.Stat(config.Firmware); err != nil {
+			problems = append(problems, fmt.Errorf("missing firmware: %w", err))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListImages(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "b.qemu.json"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "a.qemu.json"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "a.qcow2"), nil, 0644)
+	names, err := ListImages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("Unexpected images %v", names)
+	}
+}
+
+func TestValidateImages(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "unknown.qemu.json"), []byte(`{"usename": "debian"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "script.qemu.json"), []byte(`{}`), 0644)
+	os.WriteFile(filepath.Join(dir, "script.qemu.sh"), []byte("#!/bin/sh\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "orphan.qemu.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	results, err := ValidateImages(nocontext, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"unknown": {`unknown field "usename"`, "missing base image"},
+		"script":  {"missing base image", "is not executable"},
+		"orphan":  {"script has no .qemu.json file"},
+	}
+	if len(results) != len(expected) {
+		t.Errorf("Expected %d images, got %d", len(expected), len(results))
+	}
+	for name, messages := range expected {
+		problems := results[name]
+		if len(problems) != len(messages) {
+			t.Errorf("%s: expected %d problems, got %v", name, len(messages), problems)
+			continue
+		}
+		for i, message := range messages {
+			if !strings.Contains(problems[i].Error(), message) {
+				t.Errorf("%s: expected %q, got %q", name, message, problems[i])
+			}
+		}
+	}
+}
+
+func TestImageLaunch(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{"memory": 2048}`), 0644)
+	launch, err := ImageLaunch(dir, "test", Settings{CPUs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := strings.Join(launch.Command, " ")
+	if !strings.Contains(command, " -m 2048 -smp 4 ") {
+		t.Errorf("Unexpected command line:\n%s", command)
+	}
+
+	os.WriteFile(filepath.Join(dir, "test.qemu.sh"), []byte("#!/bin/sh\n"), 0755)
+	launch, err = ImageLaunch(dir, "test", Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if launch.Script != filepath.Join(dir, "test.qemu.sh") || launch.Command != nil {
+		t.Errorf("Expected the script to be used, got %+v", launch)
+	}
+}
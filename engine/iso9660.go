@@ -0,0 +1,217 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// This file implements just enough of ISO9660 to build cloud-init
+// seed images: a single root directory holding a few small files,
+// with a Joliet tree so that lowercase names are preserved.
+
+const isoSectorSize = 2048
+
+// isoFile is a file to be written in the root of an ISO image.
+type isoFile struct {
+	Name string
+	Data []byte
+}
+
+// Sector layout of the image
+const (
+	isoPrimarySector    = 16
+	isoJolietSector     = 17
+	isoTerminatorSector = 18
+	isoPathTableSector  = 19 // L and M tables for each tree, 19 to 22
+	isoPrimaryRoot      = 23
+	isoJolietRoot       = 24
+	isoFirstDataSector  = 25
+)
+
+func isoBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
+
+func isoBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+func isoSectors(size int) int {
+	return (size + isoSectorSize - 1) / isoSectorSize
+}
+
+// isoPrimaryName returns the identifier of a file in the primary
+// tree. Linux maps it back to lowercase and strips the version.
+func isoPrimaryName(name string) []byte {
+	name = strings.ToUpper(name)
+	if !strings.Contains(name, ".") {
+		name += "."
+	}
+	return []byte(name + ";1")
+}
+
+// isoJolietName returns the UCS-2 identifier of a file in the
+// Joliet tree.
+func isoJolietName(name string) []byte {
+	var buf bytes.Buffer
+	for _, c := range utf16.Encode([]rune(name)) {
+		binary.Write(&buf, binary.BigEndian, c)
+	}
+	return buf.Bytes()
+}
+
+// isoDirRecord encodes a directory record.
+func isoDirRecord(identifier []byte, sector int, size int, dir bool) []byte {
+	length := 33 + len(identifier)
+	if length%2 != 0 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	isoBoth32(r[2:10], uint32(sector))
+	isoBoth32(r[10:18], uint32(size))
+	// Recording date: 2020-01-01 00:00:00 UTC
+	copy(r[18:25], []byte{120, 1, 1, 0, 0, 0, 0})
+	if dir {
+		r[25] = 2
+	}
+	isoBoth16(r[28:32], 1)
+	r[32] = byte(len(identifier))
+	copy(r[33:], identifier)
+	return r
+}
+
+// isoDirectory encodes the root directory of a tree.
+func isoDirectory(sector int, files []isoFile, sectors []int, name func(string) []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(isoDirRecord([]byte{0}, sector, isoSectorSize, true))
+	buf.Write(isoDirRecord([]byte{1}, sector, isoSectorSize, true))
+	for i, file := range files {
+		buf.Write(isoDirRecord(name(file.Name), sectors[i], len(file.Data), false))
+	}
+	if buf.Len() > isoSectorSize {
+		return nil, errors.New("too many files for ISO directory")
+	}
+	return buf.Bytes(), nil
+}
+
+// isoPathTable encodes a path table holding only the root.
+func isoPathTable(root int, order binary.ByteOrder) []byte {
+	t := make([]byte, 10)
+	t[0] = 1
+	order.PutUint32(t[2:6], uint32(root))
+	order.PutUint16(t[6:8], 1)
+	return t
+}
+
+// isoVolumeDescriptor encodes the primary or Joliet volume
+// descriptor.
+func isoVolumeDescriptor(joliet bool, volumeID string, totalSectors int, root int, pathTable int) []byte {
+	d := make([]byte, isoSectorSize)
+	text := func(field []byte, value string) {
+		if joliet {
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, isoJolietName(value))
+		} else {
+			for i := range field {
+				field[i] = ' '
+			}
+			copy(field, value)
+		}
+	}
+
+	d[0] = 1
+	if joliet {
+		d[0] = 2
+	}
+	copy(d[1:6], "CD001")
+	d[6] = 1
+	text(d[8:40], "")
+	text(d[40:72], volumeID)
+	isoBoth32(d[80:88], uint32(totalSectors))
+	if joliet {
+		// UCS-2 level 3
+		copy(d[88:91], "%/E")
+	}
+	isoBoth16(d[120:124], 1)
+	isoBoth16(d[124:128], 1)
+	isoBoth16(d[128:132], isoSectorSize)
+	isoBoth32(d[132:140], 10)
+	binary.LittleEndian.PutUint32(d[140:144], uint32(pathTable))
+	binary.BigEndian.PutUint32(d[148:152], uint32(pathTable+1))
+	copy(d[156:190], isoDirRecord([]byte{0}, root, isoSectorSize, true))
+	text(d[190:318], "")
+	text(d[318:446], "")
+	text(d[446:574], "")
+	text(d[574:702], "")
+	text(d[702:739], "")
+	text(d[739:776], "")
+	text(d[776:813], "")
+	for _, date := range []int{813, 830, 847, 864} {
+		copy(d[date:date+16], "0000000000000000")
+	}
+	d[881] = 1
+	return d
+}
+
+// writeISO writes an ISO9660 image holding the given files.
+func writeISO(w io.Writer, volumeID string, files []isoFile) error {
+	files = append([]isoFile(nil), files...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	// Place the files after the metadata
+	sectors := make([]int, len(files))
+	next := isoFirstDataSector
+	for i, file := range files {
+		sectors[i] = next
+		next += isoSectors(len(file.Data))
+	}
+	total := next
+
+	primaryRoot, err := isoDirectory(isoPrimaryRoot, files, sectors, isoPrimaryName)
+	if err != nil {
+		return err
+	}
+	jolietRoot, err := isoDirectory(isoJolietRoot, files, sectors, isoJolietName)
+	if err != nil {
+		return err
+	}
+
+	image := make([]byte, total*isoSectorSize)
+	sector := func(n int) []byte {
+		return image[n*isoSectorSize : (n+1)*isoSectorSize]
+	}
+	copy(sector(isoPrimarySector), isoVolumeDescriptor(false, volumeID, total, isoPrimaryRoot, isoPathTableSector))
+	copy(sector(isoJolietSector), isoVolumeDescriptor(true, volumeID, total, isoJolietRoot, isoPathTableSector+2))
+	terminator := sector(isoTerminatorSector)
+	terminator[0] = 255
+	copy(terminator[1:6], "CD001")
+	terminator[6] = 1
+	copy(sector(isoPathTableSector), isoPathTable(isoPrimaryRoot, binary.LittleEndian))
+	copy(sector(isoPathTableSector+1), isoPathTable(isoPrimaryRoot, binary.BigEndian))
+	copy(sector(isoPathTableSector+2), isoPathTable(isoJolietRoot, binary.LittleEndian))
+	copy(sector(isoPathTableSector+3), isoPathTable(isoJolietRoot, binary.BigEndian))
+	copy(sector(isoPrimaryRoot), primaryRoot)
+	copy(sector(isoJolietRoot), jolietRoot)
+	for i, file := range files {
+		copy(image[sectors[i]*isoSectorSize:], file.Data)
+	}
+
+	_, err = w.Write(image)
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// readISORoot returns the files in the root directory of the tree
+// described by the volume descriptor at the given sector.
+func readISORoot(t *testing.T, image []byte, descriptor int) map[string]string {
+	d := image[descriptor*isoSectorSize:]
+	if string(d[1:6]) != "CD001" {
+		t.Fatalf("No volume descriptor at sector %d", descriptor)
+	}
+	joliet := d[0] == 2
+	root := d[156:190]
+	sector := binary.LittleEndian.Uint32(root[2:6])
+	size := binary.LittleEndian.Uint32(root[10:14])
+	dir := image[int(sector)*isoSectorSize : int(sector)*isoSectorSize+int(size)]
+
+	files := map[string]string{}
+	for len(dir) > 0 && dir[0] != 0 {
+		record := dir[:dir[0]]
+		dir = dir[dir[0]:]
+		identifier := record[33 : 33+int(record[32])]
+		if len(identifier) == 1 && identifier[0] <= 1 {
+			continue
+		}
+		var name string
+		if joliet {
+			runes := make([]uint16, len(identifier)/2)
+			binary.Read(bytes.NewReader(identifier), binary.BigEndian, runes)
+			name = string(utf16.Decode(runes))
+		} else {
+			name = string(identifier)
+		}
+		start := int(binary.LittleEndian.Uint32(record[2:6])) * isoSectorSize
+		length := int(binary.LittleEndian.Uint32(record[10:14]))
+		files[name] = string(image[start : start+length])
+	}
+	return files
+}
+
+func TestWriteISO(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeISO(&buf, "cidata", []isoFile{
+		{Name: "user-data", Data: []byte("#cloud-config\n")},
+		{Name: "meta-data", Data: bytes.Repeat([]byte("x"), 3000)},
+		{Name: "empty", Data: nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := buf.Bytes()
+	if len(image)%isoSectorSize != 0 {
+		t.Errorf("Image size %d is not a multiple of the sector size", len(image))
+	}
+
+	primary := image[isoPrimarySector*isoSectorSize:]
+	if got := string(bytes.TrimRight(primary[40:72], " ")); got != "cidata" {
+		t.Errorf("Unexpected volume ID %q", got)
+	}
+	if got := binary.LittleEndian.Uint32(primary[80:84]); int(got)*isoSectorSize != len(image) {
+		t.Errorf("Volume size %d doesn't match image size %d", got, len(image))
+	}
+	terminator := image[isoTerminatorSector*isoSectorSize:]
+	if terminator[0] != 255 || string(terminator[1:6]) != "CD001" {
+		t.Errorf("Missing volume descriptor set terminator")
+	}
+
+	files := readISORoot(t, image, isoJolietSector)
+	if len(files) != 3 {
+		t.Errorf("Expected 3 files in Joliet tree, got %d", len(files))
+	}
+	if files["user-data"] != "#cloud-config\n" {
+		t.Errorf("Unexpected user-data %q", files["user-data"])
+	}
+	if len(files["meta-data"]) != 3000 {
+		t.Errorf("Unexpected meta-data size %d", len(files["meta-data"]))
+	}
+	if _, ok := files["empty"]; !ok {
+		t.Errorf("Missing empty file")
+	}
+
+	files = readISORoot(t, image, isoPrimarySector)
+	if files["USER-DATA.;1"] != "#cloud-config\n" {
+		t.Errorf("Unexpected primary tree %v", files)
+	}
+}
@@ -6,17 +6,50 @@ package linter
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
 
+	"github.com/remram44/drone-runner-qemu/engine"
 	"github.com/remram44/drone-runner-qemu/engine/resource"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/runner-go/manifest"
 )
 
+// Most machines a pipeline can have
+const MAX_MACHINES = 16
+
+// Machine names are their hostnames on the network of the pipeline
+var hostnameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
 
 // Linter evaluates the pipeline against a set of
 // rules and returns an error if one or more of the
 // rules are broken.
-type Linter struct{}
+type Linter struct {
+	// Limits are the maximum resources a pipeline can
+	// request for its virtual machine. Zero means no limit.
+	Limits Limits
+
+	// ImageDir is where images are looked up, to check that
+	// one can run the pipeline's platform. Not checked if empty.
+	ImageDir string
+
+	// DefaultImage is used by pipelines that don't set one.
+	DefaultImage string
+
+	// LimitedRepos is set if the runner only takes the
+	// repositories matched by DRONE_LIMIT_REPOS or
+	// DRONE_LIMIT_TRUSTED, which can then use the full network
+	// without being trusted.
+	LimitedRepos bool
+}
+
+// Limits defines the maximum resources of a virtual
+// machine.
+type Limits struct {
+	CPUs     int
+	Memory   int64
+	DiskSize int64
+}
 
 // New returns a new Linter.
 func New() *Linter {
@@ -26,13 +59,118 @@ func New() *Linter {
 // Lint executes the linting rules for the pipeline
 // configuration.
 func (l *Linter) Lint(pipeline manifest.Resource, repo *drone.Repo) error {
-	return checkPipeline(pipeline.(*resource.Pipeline), repo.Trusted)
+	if err := checkPipeline(pipeline.(*resource.Pipeline), repo.Trusted, l.Limits); err != nil {
+		return err
+	}
+	if err := checkNetwork(pipeline.(*resource.Pipeline), repo.Trusted || l.LimitedRepos); err != nil {
+		return err
+	}
+	if l.ImageDir != "" {
+		return checkImage(pipeline.(*resource.Pipeline), l.ImageDir, l.DefaultImage)
+	}
+	return nil
 }
 
-func checkPipeline(pipeline *resource.Pipeline, trusted bool) error {
+func checkPipeline(pipeline *resource.Pipeline, trusted bool, limits Limits) error {
+	if err := checkVM(pipeline.VM, limits); err != nil {
+		return err
+	}
+	if err := checkMachines(pipeline, limits); err != nil {
+		return err
+	}
 	if err := checkSteps(pipeline, trusted); err != nil {
 		return err
 	}
+	if err := checkServices(pipeline); err != nil {
+		return err
+	}
+	if pipeline.Debug && !trusted {
+		return errors.New("Linter: untrusted repositories cannot use debug mode")
+	}
+	return nil
+}
+
+func checkVM(vm resource.VM, limits Limits) error {
+	if vm.CPUs < 0 {
+		return errors.New("Linter: invalid number of cpus")
+	}
+	if vm.Memory < 0 {
+		return errors.New("Linter: invalid memory size")
+	}
+	if vm.DiskSize < 0 {
+		return errors.New("Linter: invalid disk size")
+	}
+	if limits.CPUs > 0 && vm.CPUs > limits.CPUs {
+		return fmt.Errorf("Linter: number of cpus exceeds the maximum of %d", limits.CPUs)
+	}
+	if limits.Memory > 0 && int64(vm.Memory) > limits.Memory {
+		return fmt.Errorf("Linter: memory exceeds the maximum of %s", manifest.BytesSize(limits.Memory))
+	}
+	if limits.DiskSize > 0 && int64(vm.DiskSize) > limits.DiskSize {
+		return fmt.Errorf("Linter: disk size exceeds the maximum of %s", manifest.BytesSize(limits.DiskSize))
+	}
+	return nil
+}
+
+func checkImage(pipeline *resource.Pipeline, imageDir string, defaultImage string) error {
+	image := pipeline.Image
+	if image == "" {
+		image = defaultImage
+	}
+	if _, err := engine.ResolveImage(imageDir, image, pipeline.Platform.Arch); err != nil {
+		return fmt.Errorf("Linter: %v", err)
+	}
+	for _, machine := range pipeline.Machines {
+		if machine.Image == "" {
+			continue
+		}
+		if _, err := engine.ResolveImage(imageDir, machine.Image, pipeline.Platform.Arch); err != nil {
+			return fmt.Errorf("Linter: %v", err)
+		}
+	}
+	return nil
+}
+
+func checkNetwork(pipeline *resource.Pipeline, trusted bool) error {
+	if !engine.ValidNetworkPolicy(pipeline.Network) {
+		return fmt.Errorf("Linter: invalid network policy %s", pipeline.Network)
+	}
+	// Untrusted pipelines can restrict their network further, but
+	// not ask for the network of the host. The runner's default
+	// is up to its administrator
+	if pipeline.Network == engine.NETWORK_FULL && !trusted {
+		return errors.New("Linter: untrusted repositories cannot use the full network")
+	}
+	return nil
+}
+
+func checkMachines(pipeline *resource.Pipeline, limits Limits) error {
+	if len(pipeline.Machines) > 0 && pipeline.Platform.OS == "windows" {
+		return errors.New("Linter: machines are not supported on windows")
+	}
+	if len(pipeline.Machines) > MAX_MACHINES {
+		return fmt.Errorf("Linter: a pipeline cannot have more than %d machines", MAX_MACHINES)
+	}
+	names := map[string]bool{}
+	for _, machine := range pipeline.Machines {
+		if !hostnameRegexp.MatchString(machine.Name) {
+			return fmt.Errorf("Linter: invalid machine name %s, it must be a valid hostname", machine.Name)
+		}
+		if err := checkVM(machine.VM, limits); err != nil {
+			return err
+		}
+		names[machine.Name] = true
+	}
+	for _, step := range pipeline.Steps {
+		if step != nil && step.Machine != "" && !names[step.Machine] {
+			return fmt.Errorf("Linter: step %s runs on unknown machine %s", step.Name, step.Machine)
+		}
+	}
+	for _, service := range pipeline.Services {
+		if service.Machine != "" && !names[service.Machine] {
+			return fmt.Errorf("Linter: service %s runs on unknown machine %s", service.Name, service.Machine)
+		}
+	}
 	return nil
 }
 
@@ -44,3 +182,25 @@ func checkSteps(pipeline *resource.Pipeline, trusted bool) error {
 	}
 	return nil
 }
+
+func checkServices(pipeline *resource.Pipeline) error {
+	if len(pipeline.Services) > 0 && pipeline.Platform.OS == "windows" {
+		return errors.New("Linter: services are not supported on windows")
+	}
+	for _, service := range pipeline.Services {
+		if service.Probe == nil {
+			continue
+		}
+		probe := service.Probe
+		if probe.Port < 0 || probe.Port > 65535 {
+			return fmt.Errorf("Linter: invalid probe port for service %s", service.Name)
+		}
+		if probe.Port == 0 && probe.Command == "" {
+			return fmt.Errorf("Linter: probe of service %s needs a port or a command", service.Name)
+		}
+		if probe.Timeout < 0 {
+			return fmt.Errorf("Linter: invalid probe timeout for service %s", service.Name)
+		}
+	}
+	return nil
+}
@@ -17,6 +17,9 @@ func TestLint(t *testing.T) {
 	tests := []struct {
 		path    string
 		trusted bool
+		limits  Limits
+		images  string
+		limited bool
 		invalid bool
 		message string
 	}{
@@ -25,6 +28,121 @@ func TestLint(t *testing.T) {
 			trusted: false,
 			invalid: false,
 		},
+		{
+			path:    "testdata/vm.yml",
+			trusted: false,
+			invalid: false,
+		},
+		{
+			path:    "testdata/vm.yml",
+			limits:  Limits{CPUs: 8, Memory: 4 * 1024 * 1024 * 1024, DiskSize: 40 * 1024 * 1024 * 1024},
+			invalid: false,
+		},
+		{
+			path:    "testdata/vm.yml",
+			limits:  Limits{CPUs: 2},
+			invalid: true,
+			message: "Linter: number of cpus exceeds the maximum of 2",
+		},
+		{
+			path:    "testdata/vm.yml",
+			limits:  Limits{Memory: 1024 * 1024 * 1024},
+			invalid: true,
+			message: "Linter: memory exceeds the maximum of 1GiB",
+		},
+		{
+			path:    "testdata/vm.yml",
+			limits:  Limits{DiskSize: 10 * 1024 * 1024 * 1024},
+			invalid: true,
+			message: "Linter: disk size exceeds the maximum of 10GiB",
+		},
+		{
+			path:    "testdata/arm64.yml",
+			invalid: false,
+		},
+		{
+			path:    "testdata/arm64.yml",
+			images:  "testdata/images",
+			invalid: false,
+		},
+		{
+			path:    "testdata/arm64_missing.yml",
+			images:  "testdata/images",
+			invalid: true,
+			message: "Linter: image alpine-3.19 has no variant for arm64",
+		},
+		{
+			path:    "testdata/machines.yml",
+			invalid: false,
+		},
+		{
+			path:    "testdata/machines.yml",
+			limits:  Limits{Memory: 2 * 1024 * 1024 * 1024},
+			invalid: true,
+			message: "Linter: memory exceeds the maximum of 2GiB",
+		},
+		{
+			path:    "testdata/machines_unknown.yml",
+			invalid: true,
+			message: "Linter: step test runs on unknown machine database",
+		},
+		{
+			path:    "testdata/machines_hostname.yml",
+			invalid: true,
+			message: "Linter: invalid machine name Web_Server, it must be a valid hostname",
+		},
+		{
+			path:    "testdata/simple.yml",
+			invalid: false,
+		},
+		{
+			path:    "testdata/network_full.yml",
+			invalid: true,
+			message: "Linter: untrusted repositories cannot use the full network",
+		},
+		{
+			path:    "testdata/network_full.yml",
+			trusted: true,
+			invalid: false,
+		},
+		{
+			path:    "testdata/network_full.yml",
+			limited: true,
+			invalid: false,
+		},
+		{
+			path:    "testdata/network_none.yml",
+			invalid: false,
+		},
+		{
+			path:    "testdata/network_invalid.yml",
+			invalid: true,
+			message: "Linter: invalid network policy internet",
+		},
+		{
+			path:    "testdata/debug.yml",
+			invalid: true,
+			message: "Linter: untrusted repositories cannot use debug mode",
+		},
+		{
+			path:    "testdata/debug.yml",
+			trusted: true,
+			invalid: false,
+		},
+		{
+			path:    "testdata/services.yml",
+			invalid: false,
+		},
+		{
+			path:    "testdata/services_windows.yml",
+			invalid: true,
+			message: "Linter: services are not supported on windows",
+		},
+		{
+			path:    "testdata/services_probe.yml",
+			invalid: true,
+			message: "Linter: invalid probe port for service database",
+		},
 	}
 	for _, test := range tests {
 		name := path.Base(test.path)
@@ -41,6 +159,9 @@ func TestLint(t *testing.T) {
 			}
 
 			lint := New()
+			lint.Limits = test.limits
+			lint.ImageDir = test.images
+			lint.LimitedRepos = test.limited
 			opts := &drone.Repo{Trusted: test.trusted}
 			err = lint.Lint(resources.Resources[0].(*resource.Pipeline), opts)
 			if err == nil && test.invalid == true {
@@ -0,0 +1,63 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// driver boots the virtual machines that run a pipeline.
+type driver interface {
+	// reserve waits until machines with the settings fit on the
+	// host together, and reserves their resources. It returns
+	// for each machine a function releasing its share.
+	reserve(ctx context.Context, settings []Settings) ([]func(), error)
+
+	// boot starts a new machine with the settings and returns
+	// once it accepts commands. It is connected to the private
+	// network of its pipeline if lan is set. The machine calls
+	// release when it is shut down, or if it fails to boot.
+	boot(ctx context.Context, settings Settings, lan *lanConfig, release func()) (machine, error)
+
+	// cleanup frees what is left of machines that were not shut
+	// down, for example because the runner was killed.
+	cleanup(ctx context.Context) error
+
+	// collectVersions deletes image versions that are no longer
+	// current and that no machine uses.
+	collectVersions(ctx context.Context) error
+
+	// ping checks that machines can be started.
+	ping(ctx context.Context) error
+}
+
+// machine is a running virtual machine, owned by exactly one
+// pipeline.
+type machine interface {
+	// run executes a shell command on the machine, streaming
+	// its output, and returns the exit code.
+	run(ctx context.Context, command string, output io.Writer) (int, error)
+
+	// upload writes a file to the machine.
+	upload(ctx context.Context, file *File) error
+
+	// dial opens a TCP connection to a port of the guest.
+	dial(ctx context.Context, port int) (net.Conn, error)
+
+	// hostKey returns the key pinned for the guest's SSH server,
+	// or nil if the image doesn't allow it.
+	hostKey() ssh.PublicKey
+
+	// export shuts the guest down cleanly and writes its disk
+	// to a standalone image.
+	export(ctx context.Context, filename string) error
+
+	// shutdown stops the machine and frees its resources.
+	shutdown(ctx context.Context) error
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Network policies, which control what the guest can reach through
+// Qemu's user networking
+const (
+	// The guest can't reach anything
+	NETWORK_NONE = "none"
+
+	// The guest can only reach the endpoints configured on the
+	// runner
+	NETWORK_RESTRICTED = "restricted"
+
+	// The guest can reach whatever the host can
+	NETWORK_FULL = "full"
+)
+
+// The network of the guest, where endpoints get addresses
+var guestNetwork = &net.IPNet{
+	IP:   net.IPv4(10, 0, 2, 0),
+	Mask: net.CIDRMask(24, 32),
+}
+
+// ValidNetworkPolicy returns true if the policy is known. Empty
+// means full access.
+func ValidNetworkPolicy(policy string) bool {
+	switch policy {
+	case "", NETWORK_NONE, NETWORK_RESTRICTED, NETWORK_FULL:
+		return true
+	}
+	return false
+}
+
+// Endpoint is a service that guests can reach under the restricted
+// policy, at an address of their network.
+type Endpoint struct {
+	// Address and port in the guest network, such as
+	// 10.0.2.100:3128
+	Guest string
+
+	// Host and port the connections are forwarded to, such as
+	// proxy.example.com:3128
+	Host string
+}
+
+// ParseEndpoint reads an endpoint written as <guest>=<host>, such
+// as 10.0.2.100:3128=proxy.example.com:3128.
+func ParseEndpoint(value string) (Endpoint, error) {
+	guest, host, ok := strings.Cut(value, "=")
+	if !ok {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %s, expected <guest-address>:<port>=<host>:<port>", value)
+	}
+	address, port, err := net.SplitHostPort(guest)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %s: %w", value, err)
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || !guestNetwork.Contains(ip) {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %s, the guest address must be in %s", value, guestNetwork)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return Endpoint{}, fmt.Errorf("invalid port in endpoint %s", value)
+	}
+	hostName, hostPort, err := net.SplitHostPort(host)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %s: %w", value, err)
+	}
+	if _, err := strconv.ParseUint(hostPort, 10, 16); err != nil {
+		return Endpoint{}, fmt.Errorf("invalid port in endpoint %s", value)
+	}
+	if hostName == "" || strings.ContainsAny(hostName, ", ") {
+		return Endpoint{}, fmt.Errorf("invalid host in endpoint %s", value)
+	}
+	return Endpoint{Guest: guest, Host: host}, nil
+}
+
+// guestfwd returns the option of the user network backend that
+// forwards the endpoint. Each connection runs netcat on the host,
+// since a character device would only accept a single one.
+func (e Endpoint) guestfwd() string {
+	host, port, _ := net.SplitHostPort(e.Host)
+	return "guestfwd=tcp:" + e.Guest + "-cmd:nc " + host + " " + port
+}
+
+// networkOptions returns the options of the user network backend
+// enforcing the policy, starting with a comma, if any.
+func networkOptions(policy string, endpoints []Endpoint) string {
+	switch policy {
+	case NETWORK_NONE:
+		return ",restrict=on"
+	case NETWORK_RESTRICTED:
+		options := ",restrict=on"
+		for _, endpoint := range endpoints {
+			options += "," + endpoint.guestfwd()
+		}
+		return options
+	default:
+		return ""
+	}
+}
+
+// RestrictsNetwork returns true if the policy is not full access.
+// Empty means full access.
+func RestrictsNetwork(policy string) bool {
+	return policy != "" && policy != NETWORK_FULL
+}
+
+// stripNetworkOptions removes the options of an image that would
+// get around the policy, which the runner sets instead.
+func stripNetworkOptions(options string) string {
+	var kept []string
+	for _, option := range strings.Split(options, ",") {
+		if option == "" || option == "restrict" || strings.HasPrefix(option, "restrict=") || strings.HasPrefix(option, "guestfwd=") {
+			continue
+		}
+		kept = append(kept, option)
+	}
+	return strings.Join(kept, ",")
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	endpoint, err := ParseEndpoint("10.0.2.100:3128=proxy.example.com:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Guest != "10.0.2.100:3128" || endpoint.Host != "proxy.example.com:3128" {
+		t.Errorf("Unexpected endpoint %+v", endpoint)
+	}
+	if endpoint.guestfwd() != "guestfwd=tcp:10.0.2.100:3128-cmd:nc proxy.example.com 3128" {
+		t.Errorf("Unexpected guestfwd %q", endpoint.guestfwd())
+	}
+
+	for _, value := range []string{
+		"10.0.2.100:3128",
+		"192.168.1.1:3128=proxy.example.com:3128",
+		"10.0.2.100:http=proxy.example.com:3128",
+		"10.0.2.100:3128=proxy.example.com",
+		"10.0.2.100:3128=proxy,evil:3128",
+	} {
+		if _, err := ParseEndpoint(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestNetworkOptions(t *testing.T) {
+	endpoints := []Endpoint{
+		{Guest: "10.0.2.100:3128", Host: "proxy.example.com:3128"},
+		{Guest: "10.0.2.101:443", Host: "pypi.org:443"},
+	}
+	for _, test := range []struct {
+		policy  string
+		options string
+	}{
+		{"", ""},
+		{NETWORK_FULL, ""},
+		{NETWORK_NONE, ",restrict=on"},
+		{NETWORK_RESTRICTED, ",restrict=on,guestfwd=tcp:10.0.2.100:3128-cmd:nc proxy.example.com 3128,guestfwd=tcp:10.0.2.101:443-cmd:nc pypi.org 443"},
+	} {
+		if options := networkOptions(test.policy, endpoints); options != test.options {
+			t.Errorf("Unexpected options for %q: %q", test.policy, options)
+		}
+	}
+
+	if options := stripNetworkOptions("restrict=off,hostfwd=tcp::8080-:80,guestfwd=tcp:10.0.2.5:80-tcp:intranet:80,restrict"); options != "hostfwd=tcp::8080-:80" {
+		t.Errorf("Unexpected stripped options %q", options)
+	}
+}
+
+func TestQemuCommand_Network(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{
+		"nics": [{"options": "restrict=off,hostfwd=tcp::8080-:80"}]
+	}`), 0644)
+	config, err := loadMachineConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := qemuCommand(config, launchParams{
+		SSHPort: 2222,
+		Network: NETWORK_RESTRICTED,
+		Endpoints: []Endpoint{
+			{Guest: "10.0.2.100:3128", Host: "proxy.example.com:3128"},
+		},
+	})
+	command := strings.Join(args, " ")
+	expected := " -netdev user,id=net0,hostfwd=tcp:127.0.0.1:2222-:22,hostfwd=tcp::8080-:80,restrict=on,guestfwd=tcp:10.0.2.100:3128-cmd:nc proxy.example.com 3128 "
+	if !strings.Contains(command, expected) {
+		t.Errorf("Expected %q in command line:\n%s", expected, command)
+	}
+}
+
+func TestBoot_ScriptNetwork(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{"script": "run.sh"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "test.img"), []byte("image"), 0644)
+	d := &qemuDriver{
+		imageDir: dir,
+		tempDir:  t.TempDir(),
+		stateDir: t.TempDir(),
+		pinned:   map[string]int{},
+	}
+	released := false
+	_, err := d.boot(nocontext, Settings{Image: "test", Network: NETWORK_NONE}, nil, func() { released = true })
+	if err == nil || !strings.Contains(err.Error(), "doesn't enforce network policies") {
+		t.Errorf("Expected script to be refused, got %v", err)
+	}
+	if len(d.pinned) != 0 {
+		t.Errorf("Image version is still pinned")
+	}
+	if !released {
+		t.Errorf("Resources were not released")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/alessio/shellescape"
+)
+
+// Addresses of the machines on the private network of a pipeline,
+// next to the 10.0.2.0/24 network of Qemu's user networking
+const LAN_PREFIX = "10.0.3."
+
+// Last byte of the address of the first machine, the next ones
+// follow
+const LAN_FIRST_HOST = 10
+
+// lanHost is a machine on the private network.
+type lanHost struct {
+	Name    string
+	Address string
+}
+
+// lanConfig connects a machine to the private network of its
+// pipeline. The machines of a pipeline join the same multicast
+// group on the loopback interface, so they see each other's frames
+// and nothing else.
+type lanConfig struct {
+	Name    string
+	Group   string
+	MAC     string
+	Address string
+	Hosts   []lanHost
+}
+
+// newLANGroup picks a random multicast group and port for the
+// network of a pipeline, so that networks of different pipelines
+// don't mix.
+func newLANGroup() (string, error) {
+	var data [4]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return "", err
+	}
+	port := 10000 + int(binary.BigEndian.Uint16(data[2:]))%50000
+	return fmt.Sprintf("239.255.%d.%d:%d", data[0], data[1], port), nil
+}
+
+// newLANConfigs returns the network configuration of each of the
+// named machines, with addresses in the order of the names.
+func newLANConfigs(names []string) ([]*lanConfig, error) {
+	group, err := newLANGroup()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't pick a multicast group: %w", err)
+	}
+	hosts := make([]lanHost, len(names))
+	for i, name := range names {
+		hosts[i] = lanHost{
+			Name:    name,
+			Address: fmt.Sprintf("%s%d", LAN_PREFIX, LAN_FIRST_HOST+i),
+		}
+	}
+	configs := make([]*lanConfig, len(names))
+	for i := range names {
+		configs[i] = &lanConfig{
+			Name:    names[i],
+			Group:   group,
+			MAC:     fmt.Sprintf("52:54:01:00:00:%02x", LAN_FIRST_HOST+i),
+			Address: hosts[i].Address,
+			Hosts:   hosts,
+		}
+	}
+	return configs, nil
+}
+
+// netdev returns the Qemu network backend of the interface.
+func (l *lanConfig) netdev(id string) string {
+	return "socket,id=" + id + ",mcast=" + l.Group + ",localaddr=127.0.0.1"
+}
+
+// commands returns the commands configuring the interface and the
+// hostnames in the guest.
+func (l *lanConfig) commands() []string {
+	// Find the interface by its MAC address, since its name
+	// depends on the guest
+	configure := "for d in /sys/class/net/*; do " +
+		"if [ \"$(cat \"$d/address\")\" = " + l.MAC + " ]; then " +
+		"ip link set \"${d##*/}\" up && ip addr add " + l.Address + "/24 dev \"${d##*/}\"; " +
+		"fi; done"
+
+	var hosts []string
+	for _, host := range l.Hosts {
+		hosts = append(hosts, shellescape.Quote(host.Address+" "+host.Name))
+	}
+	return []string{
+		configure,
+		"printf '%s\\n' " + strings.Join(hosts, " ") + " >> /etc/hosts",
+	}
+}
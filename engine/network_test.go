@@ -0,0 +1,44 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewLANConfigs(t *testing.T) {
+	configs, err := newLANConfigs([]string{"client", "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("Expected 2 configs, got %d", len(configs))
+	}
+	if !regexp.MustCompile(`^239\.255\.[0-9]+\.[0-9]+:[0-9]+$`).MatchString(configs[0].Group) {
+		t.Errorf("Unexpected group %q", configs[0].Group)
+	}
+	if configs[1].Group != configs[0].Group {
+		t.Errorf("Machines are in different groups")
+	}
+	if configs[0].Address != "10.0.3.10" || configs[1].Address != "10.0.3.11" {
+		t.Errorf("Unexpected addresses %q %q", configs[0].Address, configs[1].Address)
+	}
+	if configs[0].MAC != "52:54:01:00:00:0a" || configs[1].MAC != "52:54:01:00:00:0b" {
+		t.Errorf("Unexpected MAC addresses %q %q", configs[0].MAC, configs[1].MAC)
+	}
+
+	commands := configs[1].commands()
+	if len(commands) != 2 {
+		t.Fatalf("Unexpected commands %q", commands)
+	}
+	if !strings.Contains(commands[0], "= 52:54:01:00:00:0b ]") || !strings.Contains(commands[0], "ip addr add 10.0.3.11/24 ") {
+		t.Errorf("Unexpected interface command %q", commands[0])
+	}
+	if commands[1] != "printf '%s\\n' '10.0.3.10 client' '10.0.3.11 server' >> /etc/hosts" {
+		t.Errorf("Unexpected hosts command %q", commands[1])
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// portAllocator hands out host ports for SSH forwarding. A port
+// is only handed out if it can be bound, and isn't handed out
+// again until the machine using it releases it.
+type portAllocator struct {
+	mu    sync.Mutex
+	inUse map[int]struct{}
+}
+
+func newPortAllocator() *portAllocator {
+	return &portAllocator{
+		inUse: map[int]struct{}{},
+	}
+}
+
+// allocate reserves a free port on the loopback interface.
+func (a *portAllocator) allocate() (int, error) {
+	for attempt := 0; attempt < 20; attempt++ {
+		// Let the kernel pick a port that is free right now
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		// It might still be reserved by a machine that hasn't
+		// bound it yet
+		a.mu.Lock()
+		_, used := a.inUse[port]
+		if !used {
+			a.inUse[port] = struct{}{}
+		}
+		a.mu.Unlock()
+		if !used {
+			return port, nil
+		}
+	}
+	return 0, errors.New("couldn't find a free port")
+}
+
+// release makes a port available again.
+func (a *portAllocator) release(port int) {
+	a.mu.Lock()
+	delete(a.inUse, port)
+	a.mu.Unlock()
+}
+
+// isPortBindError returns true if QEMU's error output shows that
+// it couldn't bind the forwarded port.
+func isPortBindError(stderr string) bool {
+	return strings.Contains(stderr, "Could not set up host forwarding rule")
+}
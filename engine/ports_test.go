@@ -0,0 +1,54 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestPortAllocator(t *testing.T) {
+	a := newPortAllocator()
+	seen := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		port, err := a.allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[port] {
+			t.Fatalf("Port %d allocated twice", port)
+		}
+		seen[port] = true
+
+		// The port can be bound
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Errorf("Allocated port %d is not free: %v", port, err)
+		} else {
+			listener.Close()
+		}
+	}
+	if len(a.inUse) != 50 {
+		t.Errorf("Expected 50 ports in use, got %d", len(a.inUse))
+	}
+	for port := range seen {
+		a.release(port)
+	}
+	if len(a.inUse) != 0 {
+		t.Errorf("Expected no ports in use, got %d", len(a.inUse))
+	}
+}
+
+func TestIsPortBindError(t *testing.T) {
+	stderr := "qemu-system-x86_64: -netdev user,id=net0,hostfwd=tcp:127.0.0.1:2222-:22: " +
+		"Could not set up host forwarding rule 'tcp:127.0.0.1:2222-:22'\n"
+	if !isPortBindError(stderr) {
+		t.Errorf("Expected port bind error to be detected")
+	}
+	if isPortBindError("qemu-system-x86_64: failed to initialize kvm\n") {
+		t.Errorf("Unexpected port bind error")
+	}
+}
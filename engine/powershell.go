@@ -0,0 +1,108 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// powershellShell runs commands through PowerShell, on Windows
+// guests running OpenSSH Server. Commands work whether the default
+// shell of the server is cmd.exe or PowerShell.
+type powershellShell struct{}
+
+// powershellQuote quotes a string for PowerShell, where nothing is
+// special between single quotes but the quote itself.
+func powershellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// powershellCommand returns a command line running a short script,
+// encoded so that it doesn't need quoting.
+func powershellCommand(script string) string {
+	// -EncodedCommand takes base64-encoded UTF-16LE
+	encoded := utf16.Encode([]rune(script))
+	data := make([]byte, 2*len(encoded))
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(data[2*i:], c)
+	}
+	return "powershell -NoProfile -NonInteractive -EncodedCommand " + base64.StdEncoding.EncodeToString(data)
+}
+
+// windowsDir returns the directory of a Windows path.
+func windowsDir(filename string) string {
+	i := strings.LastIndexAny(filename, "\\/")
+	if i <= 0 {
+		return filename
+	}
+	if i == 2 && filename[1] == ':' {
+		// Keep the root of a drive
+		return filename[:3]
+	}
+	return filename[:i]
+}
+
+func (powershellShell) makeDirectories(files []*File) string {
+	var dirs []string
+	for _, file := range files {
+		dirs = append(dirs, powershellQuote(windowsDir(file.Path)))
+	}
+	return powershellCommand(
+		"New-Item -ItemType Directory -Force -Path " + strings.Join(dirs, ",") + " | Out-Null",
+	)
+}
+
+// step writes the environment and the invocation to a script, which
+// is uploaded, because the command line of cmd.exe is too short for
+// the environment of a build. The script deletes itself, since it
+// can contain secrets.
+func (powershellShell) step(root string, step *Step, envs map[string]string) (string, []*File) {
+	var script strings.Builder
+	script.WriteString("$ErrorActionPreference = 'Stop'\r\n")
+	script.WriteString("Remove-Item -Force -LiteralPath $PSCommandPath\r\n")
+
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		script.WriteString("${env:" + strings.ReplaceAll(name, "}", "`}") + "} = " + powershellQuote(envs[name]) + "\r\n")
+	}
+
+	dir := powershellQuote(step.WorkingDir)
+	script.WriteString("New-Item -ItemType Directory -Force -Path " + dir + " | Out-Null\r\n")
+	script.WriteString("Set-Location -LiteralPath " + dir + "\r\n")
+
+	invocation := []string{"&", powershellQuote(step.Command)}
+	for _, arg := range step.Args {
+		invocation = append(invocation, powershellQuote(arg))
+	}
+	script.WriteString(strings.Join(invocation, " ") + "\r\n")
+	script.WriteString("exit $LASTEXITCODE\r\n")
+
+	file := &File{
+		Path: strings.TrimRight(root, "\\") + "\\drone-step-" + newMachineID() + ".ps1",
+		Data: []byte(script.String()),
+	}
+	command := "powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File \"" + file.Path + "\""
+	return command, []*File{file}
+}
+
+// remoteFile turns the path into one the Windows SFTP server takes,
+// such as /C:/Windows/Temp, and drops the mode, which doesn't apply.
+func (powershellShell) remoteFile(file *File) *File {
+	remote := *file
+	remote.Path = strings.ReplaceAll(file.Path, "\\", "/")
+	if len(remote.Path) >= 2 && remote.Path[1] == ':' {
+		remote.Path = "/" + remote.Path
+	}
+	remote.Mode = 0
+	return &remote
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// decodeCommand returns the script of a powershellCommand.
+func decodeCommand(t *testing.T, command string) string {
+	prefix := "powershell -NoProfile -NonInteractive -EncodedCommand "
+	if !strings.HasPrefix(command, prefix) {
+		t.Fatalf("Unexpected command %q", command)
+	}
+	data, err := base64.StdEncoding.DecodeString(command[len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := make([]uint16, len(data)/2)
+	for i := range encoded {
+		encoded[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(encoded))
+}
+
+func TestPowershell_MakeDirectories(t *testing.T) {
+	command := powershellShell{}.makeDirectories([]*File{
+		{Path: "C:\\Windows\\Temp\\drone-abc\\opt\\build.ps1"},
+		{Path: "C:\\Users\\it's me\\file"},
+		{Path: "C:\\file"},
+	})
+	script := decodeCommand(t, command)
+	expected := "New-Item -ItemType Directory -Force -Path 'C:\\Windows\\Temp\\drone-abc\\opt','C:\\Users\\it''s me','C:\\' | Out-Null"
+	if script != expected {
+		t.Errorf("%#v != %#v", script, expected)
+	}
+}
+
+func TestPowershell_Step(t *testing.T) {
+	command, files := powershellShell{}.step(
+		"C:\\Windows\\Temp\\drone-abc",
+		&Step{
+			Command:    "powershell",
+			Args:       []string{"-noprofile", "C:\\Windows\\Temp\\drone-abc\\opt\\build.ps1"},
+			WorkingDir: "C:\\Windows\\Temp\\drone-abc\\drone\\src",
+		},
+		map[string]string{
+			"DRONE_COMMIT_MESSAGE": "it's fixed",
+			"CI":                   "true",
+		},
+	)
+	if len(files) != 1 {
+		t.Fatalf("Expected one file, got %d", len(files))
+	}
+	file := files[0]
+	if !strings.HasPrefix(file.Path, "C:\\Windows\\Temp\\drone-abc\\drone-step-") || !strings.HasSuffix(file.Path, ".ps1") {
+		t.Errorf("Unexpected script path %q", file.Path)
+	}
+	if command != "powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File \""+file.Path+"\"" {
+		t.Errorf("Unexpected command %q", command)
+	}
+	expected := strings.Join([]string{
+		"$ErrorActionPreference = 'Stop'",
+		"Remove-Item -Force -LiteralPath $PSCommandPath",
+		"${env:CI} = 'true'",
+		"${env:DRONE_COMMIT_MESSAGE} = 'it''s fixed'",
+		"New-Item -ItemType Directory -Force -Path 'C:\\Windows\\Temp\\drone-abc\\drone\\src' | Out-Null",
+		"Set-Location -LiteralPath 'C:\\Windows\\Temp\\drone-abc\\drone\\src'",
+		"& 'powershell' '-noprofile' 'C:\\Windows\\Temp\\drone-abc\\opt\\build.ps1'",
+		"exit $LASTEXITCODE",
+		"",
+	}, "\r\n")
+	if string(file.Data) != expected {
+		t.Errorf("Unexpected script:\n%s", file.Data)
+	}
+}
+
+func TestPowershell_RemoteFile(t *testing.T) {
+	file := &File{Path: "C:\\Windows\\Temp\\drone-abc\\opt\\build.ps1", Mode: 0700}
+	remote := powershellShell{}.remoteFile(file)
+	if remote.Path != "/C:/Windows/Temp/drone-abc/opt/build.ps1" || remote.Mode != 0 {
+		t.Errorf("Unexpected remote file %q %o", remote.Path, remote.Mode)
+	}
+	if file.Path != "C:\\Windows\\Temp\\drone-abc\\opt\\build.ps1" {
+		t.Errorf("Original file was modified")
+	}
+}
+
+func TestEngine_RunWindows(t *testing.T) {
+	e, _ := newFakeEngine()
+	spec := &Spec{
+		Root:     "C:\\Windows\\Temp\\drone-abc",
+		Settings: Settings{Image: "windows", OS: "windows"},
+	}
+	if err := e.Setup(nocontext, spec); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Destroy(nocontext, spec)
+	step := &Step{
+		Command:    "powershell",
+		WorkingDir: "C:\\Windows\\Temp\\drone-abc\\drone\\src",
+		Files:      []*File{{Path: "C:\\Windows\\Temp\\drone-abc\\opt\\build.ps1"}},
+	}
+	var output strings.Builder
+	if _, err := e.Run(nocontext, spec, step, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	m, _ := e.lookup(spec)
+	fake := m.(*fakeMachine)
+	if len(fake.uploads) != 2 || fake.uploads[0] != "/C:/Windows/Temp/drone-abc/opt/build.ps1" || !strings.HasPrefix(fake.uploads[1], "/C:/Windows/Temp/drone-abc/drone-step-") {
+		t.Errorf("Unexpected uploads %q", fake.uploads)
+	}
+	last := fake.commands[len(fake.commands)-1]
+	if !strings.HasPrefix(last, "powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File ") {
+		t.Errorf("Unexpected command %q", last)
+	}
+	if len(step.Files) != 1 {
+		t.Errorf("Step was modified")
+	}
+}
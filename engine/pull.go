@@ -0,0 +1,292 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A SHA-256 checksum in hexadecimal
+var checksumRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ImageManifest lists the images that can be pulled, by name.
+type ImageManifest map[string]ManifestImage
+
+// ManifestImage is where to get an image, and how to check it.
+type ManifestImage struct {
+	// Relative URLs are relative to the manifest
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Format string `json:"format,omitempty"`
+
+	// Written to the .qemu.json file of the image
+	Config MachineConfig `json:"config,omitempty"`
+}
+
+// parseLocation turns a URL or a local path into a URL.
+func parseLocation(location string) (*url.URL, error) {
+	if strings.Contains(location, "://") {
+		return url.Parse(location)
+	}
+	absolute, err := filepath.Abs(location)
+	if err != nil {
+		return nil, err
+	}
+	return &url.URL{Scheme: "file", Path: absolute}, nil
+}
+
+// openURL opens a file:// or http(s):// URL, starting at the given
+// offset if possible. It returns whether the offset was applied.
+func openURL(ctx context.Context, location *url.URL, offset int64) (io.ReadCloser, bool, error) {
+	switch location.Scheme {
+	case "file":
+		file, err := os.Open(location.Path)
+		if err != nil {
+			return nil, false, err
+		}
+		if offset > 0 {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				file.Close()
+				return nil, false, err
+			}
+		}
+		return file, true, nil
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, "GET", location.String(), nil)
+		if err != nil {
+			return nil, false, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, false, err
+		}
+		switch {
+		case offset > 0 && res.StatusCode == http.StatusPartialContent:
+			return res.Body, true, nil
+		case res.StatusCode == http.StatusOK:
+			return res.Body, false, nil
+		case res.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+			// The partial file is complete, or bigger than
+			// the file on the server
+			res.Body.Close()
+			return openURL(ctx, location, 0)
+		default:
+			res.Body.Close()
+			return nil, false, fmt.Errorf("%s: %s", location, res.Status)
+		}
+	default:
+		return nil, false, fmt.Errorf("unsupported URL scheme %#v", location.Scheme)
+	}
+}
+
+// LoadImageManifest reads a manifest from a local path or a URL. It
+// returns the location of the manifest, to resolve relative URLs.
+func LoadImageManifest(ctx context.Context, location string) (ImageManifest, *url.URL, error) {
+	base, err := parseLocation(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, _, err := openURL(ctx, base, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	var manifest ImageManifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid image manifest: %w", err)
+	}
+	for name, image := range manifest {
+		if image.URL == "" || image.SHA256 == "" {
+			return nil, nil, fmt.Errorf("image %s needs a url and a sha256", name)
+		}
+		if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			return nil, nil, fmt.Errorf("invalid image name %#v", name)
+		}
+		if err := image.validate(); err != nil {
+			return nil, nil, fmt.Errorf("image %s: %w", name, err)
+		}
+	}
+	return manifest, base, nil
+}
+
+// validate checks the fields that file names are made from.
+func (image ManifestImage) validate() error {
+	if !checksumRegexp.MatchString(strings.ToLower(image.SHA256)) {
+		return fmt.Errorf("invalid sha256 %#v", image.SHA256)
+	}
+	switch image.Format {
+	case "", "qcow2", "raw":
+	default:
+		return fmt.Errorf("invalid format %#v, expected qcow2 or raw", image.Format)
+	}
+	return nil
+}
+
+// download fetches a URL into a file, continuing from what is
+// already in the file, and returns the SHA-256 of the whole file.
+func download(ctx context.Context, location *url.URL, filename string) (string, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	body, resumed, err := openURL(ctx, location, offset)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if offset > 0 {
+		if resumed {
+			logrus.WithField("offset", offset).Info("resuming download")
+		} else {
+			// Start over
+			if err := file.Truncate(0); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Hash what we already have, then the rest as it comes
+	hash := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileAtomic writes a file through a temporary file, so that
+// it is never seen partially written.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	temp := path.Join(path.Dir(filename), "."+path.Base(filename)+".tmp")
+	if err := os.WriteFile(temp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+// PullImage downloads an image into the version store if it is not
+// already there, verifies its checksum, and points its .qemu.json
+// file to it.
+func PullImage(ctx context.Context, imageDir string, name string, image ManifestImage, base *url.URL) error {
+	log := logrus.WithField("image", name)
+	if err := image.validate(); err != nil {
+		return err
+	}
+	location, err := base.Parse(image.URL)
+	if err != nil {
+		return err
+	}
+	checksum := strings.ToLower(image.SHA256)
+
+	config := image.Config
+	format := image.Format
+	if format == "" {
+		format = "qcow2"
+	}
+	config.BaseImageFormat = format
+	config.BaseImage = versionFile(checksum, format)
+	config.SHA256 = checksum
+	target := path.Join(imageDir, config.BaseImage)
+
+	// Skip the download if we already have this version
+	current, err := loadMachineConfig(imageDir, name)
+	if err == nil && current.SHA256 == checksum && current.BaseImage == target {
+		log.Info("image is up to date")
+		return nil
+	}
+	if _, err := os.Stat(target); err == nil {
+		log.Info("image version is already stored")
+	} else {
+		// Download into the store, so it can be moved atomically
+		if err := os.MkdirAll(path.Join(imageDir, VERSIONS_DIR), 0755); err != nil {
+			return err
+		}
+		partial := path.Join(imageDir, VERSIONS_DIR, "."+checksum+".download")
+		log.WithField("url", location.String()).Info("downloading image")
+		actual, err := download(ctx, location, partial)
+		if err != nil {
+			return fmt.Errorf("download failed: %w", err)
+		}
+		if actual != checksum {
+			os.Remove(partial)
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, actual)
+		}
+		if _, err := storeVersion(imageDir, partial, checksum, format); err != nil {
+			return err
+		}
+		log.Info("image downloaded")
+	}
+
+	// Switch to the new version, machines already running keep
+	// using the old one
+	return writeImageConfig(imageDir, name, config)
+}
+
+// PullImages downloads the given images from a manifest, or all of
+// them if no names are given.
+func PullImages(ctx context.Context, imageDir string, manifestLocation string, names []string) error {
+	manifest, base, err := LoadImageManifest(ctx, manifestLocation)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		for name := range manifest {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var failed []string
+	for _, name := range names {
+		image, ok := manifest[name]
+		if !ok {
+			return fmt.Errorf("image %s is not in the manifest", name)
+		}
+		if err := PullImage(ctx, imageDir, name, image, base); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logrus.WithError(err).WithField("image", name).Error("couldn't pull image")
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("couldn't pull images: " + strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeManifest(t *testing.T, dir string, url string, checksum string) string {
+	filename := filepath.Join(dir, "manifest.json")
+	os.WriteFile(filename, []byte(fmt.Sprintf(`{
+		"test": {
+			"url": %q,
+			"sha256": %q,
+			"format": "qcow2",
+			"config": {"username": "debian"}
+		}
+	}`, url, checksum)), 0644)
+	return filename
+}
+
+func TestPullImages_File(t *testing.T) {
+	mirror := t.TempDir()
+	imageDir := t.TempDir()
+	data := []byte("not really a disk image")
+	hash := sha256.Sum256(data)
+	checksum := hex.EncodeToString(hash[:])
+	os.WriteFile(filepath.Join(mirror, "test.qcow2"), data, 0644)
+
+	// Relative to the manifest
+	manifest := writeManifest(t, mirror, "test.qcow2", checksum)
+	if err := PullImages(nocontext, imageDir, "file://"+manifest, nil); err != nil {
+		t.Fatal(err)
+	}
+	version := filepath.Join(imageDir, "versions", checksum+".qcow2")
+	got, _ := os.ReadFile(version)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Unexpected image content %q", got)
+	}
+	config, err := loadMachineConfig(imageDir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "debian" || config.SHA256 != checksum || config.BaseImageFormat != "qcow2" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if config.BaseImage != version {
+		t.Errorf("Unexpected base image %q", config.BaseImage)
+	}
+
+	// Up to date, the mirror is not read again
+	os.Remove(filepath.Join(mirror, "test.qcow2"))
+	if err := PullImages(nocontext, imageDir, manifest, []string{"test"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullImages_Checksum(t *testing.T) {
+	mirror := t.TempDir()
+	imageDir := t.TempDir()
+	os.WriteFile(filepath.Join(mirror, "test.qcow2"), []byte("corrupted"), 0644)
+	manifest := writeManifest(t, mirror, "test.qcow2", strings.Repeat("0", 64))
+	if err := PullImages(nocontext, imageDir, manifest, nil); err == nil {
+		t.Fatal("Expected checksum error")
+	}
+	if _, err := os.Stat(filepath.Join(imageDir, "test.qemu.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected no machine config")
+	}
+	entries, _ := os.ReadDir(filepath.Join(imageDir, "versions"))
+	if len(entries) != 0 {
+		t.Errorf("Expected no files in version store, got %d", len(entries))
+	}
+}
+
+func TestPullImages_HTTPResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	hash := sha256.Sum256(data)
+	checksum := hex.EncodeToString(hash[:])
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "test.qcow2", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	imageDir := t.TempDir()
+	manifest := writeManifest(t, t.TempDir(), server.URL+"/images/test.qcow2", checksum)
+
+	// Part of the file was downloaded before
+	partial := filepath.Join(imageDir, "versions", "."+checksum+".download")
+	os.Mkdir(filepath.Join(imageDir, "versions"), 0755)
+	os.WriteFile(partial, data[:4000], 0644)
+
+	if err := PullImages(nocontext, imageDir, manifest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=4000-" {
+		t.Errorf("Expected a resumed download, got ranges %q", ranges)
+	}
+	got, _ := os.ReadFile(filepath.Join(imageDir, "versions", checksum+".qcow2"))
+	if !bytes.Equal(got, data) {
+		t.Errorf("Downloaded image doesn't match")
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Partial download was left behind")
+	}
+}
+
+func TestLoadImageManifest_Invalid(t *testing.T) {
+	for _, test := range []struct {
+		checksum string
+		format   string
+	}{
+		{"../../x", "qcow2"},
+		{strings.Repeat("0", 63), "qcow2"},
+		{strings.Repeat("g", 64), "qcow2"},
+		{strings.Repeat("0", 64), "../qcow2"},
+		{strings.Repeat("0", 64), "vmdk"},
+	} {
+		filename := filepath.Join(t.TempDir(), "manifest.json")
+		os.WriteFile(filename, []byte(fmt.Sprintf(
+			`{"test": {"url": "test.qcow2", "sha256": %q, "format": %q}}`,
+			test.checksum, test.format,
+		)), 0644)
+		if _, _, err := LoadImageManifest(nocontext, filename); err == nil {
+			t.Errorf("Expected error for sha256 %q, format %q", test.checksum, test.format)
+		}
+	}
+
+	// Upper case is fine
+	filename := writeManifest(t, t.TempDir(), "test.qcow2", strings.Repeat("A", 64))
+	if _, _, err := LoadImageManifest(nocontext, filename); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,654 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const PORT_MAX_ATTEMPTS = 5
+
+const QMP_CONNECT_DELAY time.Duration = 10 * time.Second
+
+const QMP_COMMAND_TIMEOUT time.Duration = 5 * time.Second
+
+const POWERDOWN_TIMEOUT time.Duration = 10 * time.Second
+
+const QUIT_TIMEOUT time.Duration = 5 * time.Second
+
+var errPortInUse = errors.New("qemu couldn't bind the SSH port")
+
+// qemuDriver boots machines by running Qemu, or the image's
+// script, on top of a temporary overlay image.
+type qemuDriver struct {
+	imageDir  string
+	tempDir   string
+	stateDir  string
+	ports     *portAllocator
+	admission *admission
+	allowTCG  bool
+
+	// Reachable by guests whose network is restricted
+	endpoints []Endpoint
+
+	// IDs of the machines that haven't been shut down
+	mu   sync.Mutex
+	live map[string]struct{}
+
+	// Number of machines using each image version, and the versions
+	// copied from image files placed by hand
+	versionsMu sync.Mutex
+	pinned     map[string]int
+	copies     map[string]imageCopy
+
+	// Held while an image file is copied to the version store
+	copyMu sync.Mutex
+}
+
+func (d *qemuDriver) isLive(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.live[id]
+	return ok
+}
+
+func (d *qemuDriver) setLive(id string, live bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if live {
+		d.live[id] = struct{}{}
+	} else {
+		delete(d.live, id)
+	}
+}
+
+// qemuMachine is a machine started by the qemuDriver.
+type qemuMachine struct {
+	id        string
+	config    MachineConfig
+	image     string
+	seedImage string
+	sshPort   int
+	driver    *qemuDriver
+	record    *machineRecord
+	ports     *portAllocator
+	release   func()
+	unpin     func()
+	lan       *lanConfig
+	network   string
+	sshConfig *ssh.ClientConfig
+	sshKey    ssh.PublicKey
+	clientKey ssh.PublicKey
+	transport *sshTransport
+	process   *os.Process
+	exitChan  chan struct{}
+	qmpSocket string
+
+	readySocket string
+	readyToken  string
+
+	consoleLog string
+	console    *consoleLog
+
+	// Set from the QMP goroutines
+	mu              sync.Mutex
+	qmp             *qmpClient
+	guestDown       chan struct{}
+	guestDownReason string
+}
+
+func (d *qemuDriver) reserve(ctx context.Context, settings []Settings) ([]func(), error) {
+	memory := make([]int, len(settings))
+	cpus := make([]int, len(settings))
+	for i, machineSettings := range settings {
+		config, err := loadMachineConfig(d.imageDir, machineSettings.Image)
+		if err != nil {
+			return nil, fmt.Errorf("error loading machine config JSON: %w", err)
+		}
+		config.applySettings(machineSettings)
+		memory[i] = config.Memory
+		cpus[i] = config.SMP
+	}
+	return d.admission.acquireGroup(ctx, memory, cpus)
+}
+
+func (d *qemuDriver) boot(ctx context.Context, settings Settings, lan *lanConfig, release func()) (machine, error) {
+	// Load configuration, keeping the current version of the
+	// image until the machine is gone
+	config, unpin, err := d.loadConfig(settings.Image)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("error loading machine config JSON: %w", err)
+	}
+	if settings.Arch != "" && config.Arch != settings.Arch {
+		unpin()
+		release()
+		return nil, fmt.Errorf("image %s is for %s, not %s", settings.Image, config.Arch, settings.Arch)
+	}
+	config.applySettings(settings)
+
+	// The network policy is enforced on the command line, which
+	// scripts build themselves
+	if !ValidNetworkPolicy(settings.Network) {
+		unpin()
+		release()
+		return nil, fmt.Errorf("invalid network policy %s", settings.Network)
+	}
+	if config.Script != "" && !config.EnforcesNetwork && RestrictsNetwork(settings.Network) {
+		unpin()
+		release()
+		return nil, fmt.Errorf("image %s runs from a script that doesn't enforce network policies, but the network is %s", settings.Image, settings.Network)
+	}
+
+	// Emulate the CPU if we can't use KVM
+	if config.Script == "" && config.Accel == "kvm" && d.allowTCG {
+		if err := kvmAvailable(); err != nil {
+			logrus.WithError(err).Warn("KVM is not available, emulating the CPU")
+			config.Accel = "tcg"
+			if config.CPU == "host" {
+				config.CPU = "max"
+			}
+		}
+	}
+
+	m := &qemuMachine{
+		id:      newMachineID(),
+		config:  config,
+		driver:  d,
+		ports:   d.ports,
+		release: release,
+		unpin:   unpin,
+		lan:     lan,
+		network: settings.Network,
+	}
+	seed := &seed{
+		InstanceID: "drone-" + m.id,
+		Hostname:   "drone-" + m.id,
+	}
+
+	// Machines on a private network are known by their names
+	if lan != nil {
+		seed.Hostname = lan.Name
+		seed.RunCommands = append(seed.RunCommands, lan.commands()...)
+	}
+
+	// Generate a key that is only valid for this machine
+	_, signer, err := newKey()
+	if err != nil {
+		m.shutdown(ctx)
+		return nil, fmt.Errorf("error generating SSH key: %w", err)
+	}
+	seed.AuthorizedKey = signer.PublicKey()
+	m.clientKey = signer.PublicKey()
+	m.sshConfig = &ssh.ClientConfig{
+		User:    config.Username,
+		Auth:    []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		Timeout: SSH_CONNECT_TIMEOUT,
+	}
+
+	// Generate the host key of the machine, so we can make sure
+	// we are talking to it and not to whoever took the port
+	if config.InsecureIgnoreHostKey {
+		m.sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		hostKey, hostSigner, err := newKey()
+		if err != nil {
+			m.shutdown(ctx)
+			return nil, fmt.Errorf("error generating SSH host key: %w", err)
+		}
+		seed.HostKey = hostKey
+		m.sshKey = hostSigner.PublicKey()
+		m.sshConfig.HostKeyCallback = ssh.FixedHostKey(m.sshKey)
+		m.sshConfig.HostKeyAlgorithms = []string{ssh.KeyAlgoED25519}
+	}
+
+	// Files and sockets of the machine
+	m.image = path.Join(d.tempDir, fmt.Sprintf("drone-qemu-%s.qcow2", m.id))
+	m.seedImage = path.Join(d.tempDir, fmt.Sprintf("drone-qemu-%s-seed.iso", m.id))
+	m.qmpSocket = path.Join(d.tempDir, fmt.Sprintf("drone-qemu-%s-qmp.sock", m.id))
+	m.readySocket = path.Join(d.tempDir, fmt.Sprintf("drone-qemu-%s-ready.sock", m.id))
+	m.consoleLog = path.Join(d.tempDir, fmt.Sprintf("drone-qemu-%s-console.log", m.id))
+
+	// Record the machine before creating anything, so it can be
+	// cleaned up if the runner dies
+	d.setLive(m.id, true)
+	m.record = newMachineRecord(m.id, settings.BuildID)
+	m.record.BaseImage = absPath(config.BaseImage)
+	m.record.Files = []string{m.image, m.seedImage, m.qmpSocket, m.readySocket, m.consoleLog}
+	err = m.record.write(d.stateDir)
+	if err != nil {
+		m.shutdown(ctx)
+		return nil, fmt.Errorf("error writing machine record: %w", err)
+	}
+
+	// Have the guest tell us when it is done booting
+	if config.Readiness.Method == ReadinessVirtioSerial {
+		m.readyToken = newMachineID()
+		seed.RunCommands = append(seed.RunCommands, readyCommand(m.readyToken))
+	}
+
+	// Have the guest use the space if the disk gets resized
+	seed.GrowRoot = config.diskSize > 0
+
+	// Write the cloud-init seed
+	err = seed.writeImage(m.seedImage)
+	if err != nil {
+		m.shutdown(ctx)
+		return nil, fmt.Errorf("error writing cloud-init seed: %w", err)
+	}
+
+	// Create the temporary image
+	logrus.WithFields(logrus.Fields{
+		"image": m.image,
+	}).Info("creating image")
+	err = exec.CommandContext(
+		ctx,
+		"qemu-img", "create",
+		"-f", "qcow2",
+		"-b", config.BaseImage,
+		"-F", config.BaseImageFormat,
+		m.image,
+	).Run()
+	if err != nil {
+		m.shutdown(ctx)
+		return nil, fmt.Errorf("qemu-img failed: %w", err)
+	}
+
+	// Grow the disk to the requested size
+	if config.diskSize > 0 {
+		err = growImage(ctx, m.image, config.diskSize)
+		if err != nil {
+			m.shutdown(ctx)
+			return nil, err
+		}
+	}
+
+	// Record the output of Qemu, which includes the serial console
+	m.console, err = newConsoleLog(m.consoleLog, CONSOLE_LOG_MAX_SIZE)
+	if err != nil {
+		m.shutdown(ctx)
+		return nil, fmt.Errorf("couldn't create console log: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"log": m.consoleLog,
+	}).Debug("recording console")
+
+	// Start Qemu
+	err = m.startWithPort(ctx)
+	if err != nil {
+		// Show what the machine printed, so the problem can be
+		// diagnosed from the build
+		if tail := m.console.tail(); tail != "" {
+			logrus.WithError(err).Warnf("machine failed to boot, last output:\n%s", tail)
+			err = fmt.Errorf("%w, last output:\n%s", err, tail)
+		}
+		m.shutdown(ctx)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// growImage resizes a disk image to the given size in bytes, unless
+// it is already as large. Qemu doesn't shrink images, which could
+// lose data.
+func growImage(ctx context.Context, filename string, size int64) error {
+	info, err := readImageInfo(ctx, filename)
+	if err != nil {
+		return fmt.Errorf("couldn't read the size of the image: %w", err)
+	}
+	if size <= info.VirtualSize {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"size": size,
+	}).Info("resizing image")
+	output, err := exec.CommandContext(
+		ctx,
+		"qemu-img", "resize",
+		"-f", "qcow2",
+		filename,
+		strconv.FormatInt(size, 10),
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img resize failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// startWithPort starts Qemu, trying again with another port if it
+// couldn't bind the one we picked.
+func (m *qemuMachine) startWithPort(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		var err error
+		m.sshPort, err = m.ports.allocate()
+		if err != nil {
+			return err
+		}
+		err = m.start(ctx)
+		if err != errPortInUse || attempt >= PORT_MAX_ATTEMPTS {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"port": m.sshPort,
+		}).Warn("qemu couldn't bind port, retrying")
+		m.ports.release(m.sshPort)
+		m.sshPort = 0
+	}
+}
+
+// start runs Qemu and waits for the machine to accept SSH
+// connections.
+func (m *qemuMachine) start(ctx context.Context) error {
+	params := launchParams{
+		Image:       m.image,
+		SeedImage:   m.seedImage,
+		SSHPort:     m.sshPort,
+		QMPSocket:   m.qmpSocket,
+		ReadySocket: m.readySocket,
+		LAN:         m.lan,
+		Network:     m.network,
+		Endpoints:   m.driver.endpoints,
+	}
+	var cmd *exec.Cmd
+	if m.config.Script != "" {
+		logrus.WithFields(logrus.Fields{
+			"script": m.config.Script,
+		}).Info("starting qemu")
+		cmd = exec.CommandContext(ctx, m.config.Script)
+		cmd.Env = params.environ(m.config)
+	} else {
+		args := qemuCommand(m.config, params)
+		logrus.WithFields(logrus.Fields{
+			"args": args,
+		}).Info("starting qemu")
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	}
+	// Only look at the output of this attempt to tell why it
+	// failed
+	m.console.reset()
+	cmd.Stdout = m.console
+	cmd.Stderr = m.console
+	// Own process group, so we can kill Qemu even if the script
+	// didn't exec it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("qemu process failed to start: %w", err)
+	}
+	m.process = cmd.Process
+	m.record.PID = cmd.Process.Pid
+	m.record.PIDStarted, _ = processStartTime(cmd.Process.Pid)
+	m.record.Port = m.sshPort
+	if err := m.record.write(m.driver.stateDir); err != nil {
+		logrus.WithError(err).Warn("couldn't update machine record")
+	}
+	exitChan := make(chan struct{})
+	m.exitChan = exitChan
+	go func() {
+		cmd.Wait()
+		close(exitChan)
+	}()
+	guestDown := make(chan struct{})
+	m.mu.Lock()
+	m.qmp = nil
+	m.guestDown = guestDown
+	m.mu.Unlock()
+	go m.connectQMP(exitChan)
+
+	// Wait for the machine to boot, giving up if Qemu exits
+	bootCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	bootChannel := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		bootChannel <- m.waitBoot(bootCtx)
+	}()
+
+	select {
+	case <-exitChan:
+		// The error output is complete once the process is done
+		if isPortBindError(m.console.tail()) {
+			return errPortInUse
+		}
+		return fmt.Errorf("qemu process died")
+	case <-guestDown:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return errors.New(m.guestDownReason)
+	case err := <-bootChannel:
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"duration": time.Since(start),
+		}).Info("machine has started")
+	}
+
+	return nil
+}
+
+// connectQMP connects to the QMP socket once Qemu has created it,
+// and watches the events coming from the guest.
+func (m *qemuMachine) connectQMP(exitChan chan struct{}) {
+	deadline := time.Now().Add(QMP_CONNECT_DELAY)
+	var client *qmpClient
+	for {
+		var err error
+		ctx, cancel := context.WithTimeout(context.Background(), QMP_COMMAND_TIMEOUT)
+		client, err = dialQMP(ctx, m.qmpSocket)
+		cancel()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			logrus.WithError(err).Warn("couldn't connect to QMP socket, machine will be stopped with signals")
+			return
+		}
+		select {
+		case <-exitChan:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	m.mu.Lock()
+	m.qmp = client
+	m.mu.Unlock()
+
+	for event := range client.events {
+		switch event.Event {
+		case "GUEST_PANICKED":
+			logrus.Warn("guest kernel panicked")
+			m.setGuestDown("guest kernel panicked")
+			// Don't leave it paused, steps will fail right away
+			ctx, cancel := context.WithTimeout(context.Background(), QMP_COMMAND_TIMEOUT)
+			client.execute(ctx, "quit", nil)
+			cancel()
+		case "SHUTDOWN":
+			logrus.Info("guest shut down")
+			m.setGuestDown("guest shut down")
+		}
+	}
+}
+
+// setGuestDown records that the guest stopped running on its own.
+func (m *qemuMachine) setGuestDown(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.guestDownReason == "" {
+		m.guestDownReason = reason
+		close(m.guestDown)
+	}
+}
+
+// getQMP returns the QMP client, if connected.
+func (m *qemuMachine) getQMP() *qmpClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.qmp
+}
+
+// status returns the run state of the machine, or nil if it can't
+// be queried.
+func (m *qemuMachine) status() *qmpStatus {
+	client := m.getQMP()
+	if client == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), QMP_COMMAND_TIMEOUT)
+	defer cancel()
+	status, err := client.status(ctx)
+	if err != nil {
+		return nil
+	}
+	return status
+}
+
+// waitExit waits for Qemu to exit, up to the given delay.
+func (m *qemuMachine) waitExit(delay time.Duration) bool {
+	select {
+	case <-m.exitChan:
+		return true
+	case <-time.After(delay):
+		return false
+	}
+}
+
+// stop stops Qemu, asking the guest to power down first, then
+// asking Qemu to quit, and finally killing it.
+func (m *qemuMachine) stop() {
+	// Nothing to do if it already exited
+	select {
+	case <-m.exitChan:
+		return
+	default:
+	}
+
+	client := m.getQMP()
+	if client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), QMP_COMMAND_TIMEOUT)
+		_, err := client.execute(ctx, "system_powerdown", nil)
+		cancel()
+		if err == nil && m.waitExit(POWERDOWN_TIMEOUT) {
+			return
+		}
+		logrus.Info("machine didn't power down, asking qemu to quit")
+		ctx, cancel = context.WithTimeout(context.Background(), QMP_COMMAND_TIMEOUT)
+		client.execute(ctx, "quit", nil)
+		cancel()
+	} else {
+		m.process.Signal(syscall.SIGINT)
+	}
+	if m.waitExit(QUIT_TIMEOUT) {
+		return
+	}
+
+	logrus.Warn("qemu didn't quit, killing it")
+	syscall.Kill(-m.process.Pid, syscall.SIGKILL)
+	<-m.exitChan
+}
+
+// connect opens the SSH connection and checks that it can run
+// commands.
+func (m *qemuMachine) connect(ctx context.Context) error {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(m.sshPort))
+	transport, err := dialSSH(ctx, addr, m.sshConfig)
+	if err != nil {
+		return err
+	}
+	exitCode, err := transport.run(ctx, "true", io.Discard)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+	if err != nil {
+		transport.close()
+		return err
+	}
+	m.transport = transport
+	return nil
+}
+
+func (m *qemuMachine) run(ctx context.Context, command string, output io.Writer) (int, error) {
+	return m.transport.run(ctx, command, output)
+}
+
+func (m *qemuMachine) upload(ctx context.Context, file *File) error {
+	return m.transport.upload(ctx, file)
+}
+
+func (m *qemuMachine) dial(ctx context.Context, port int) (net.Conn, error) {
+	return m.transport.dial(ctx, port)
+}
+
+func (m *qemuMachine) hostKey() ssh.PublicKey {
+	return m.sshKey
+}
+
+func (m *qemuMachine) shutdown(ctx context.Context) error {
+	// Close the SSH connection
+	if m.transport != nil {
+		m.transport.close()
+	}
+
+	// Stop the Qemu process
+	if m.process != nil {
+		m.stop()
+	}
+	if client := m.getQMP(); client != nil {
+		client.close()
+	}
+	if m.qmpSocket != "" {
+		os.Remove(m.qmpSocket)
+	}
+	if m.readySocket != "" {
+		os.Remove(m.readySocket)
+	}
+	if m.console != nil {
+		m.console.close()
+		os.Remove(m.consoleLog)
+	}
+
+	// Give back the port
+	if m.sshPort != 0 {
+		m.ports.release(m.sshPort)
+		m.sshPort = 0
+	}
+
+	// Delete the temporary images
+	if m.image != "" {
+		os.Remove(m.image)
+	}
+	if m.seedImage != "" {
+		os.Remove(m.seedImage)
+	}
+
+	// Give back the memory and CPUs
+	m.release()
+	m.unpin()
+
+	// Everything is gone, forget about the machine
+	if m.record != nil {
+		os.Remove(recordPath(m.driver.stateDir, m.id))
+		m.driver.setLive(m.id, false)
+	}
+
+	return nil
+}
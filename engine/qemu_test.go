@@ -0,0 +1,99 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrowImage(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img is not available")
+	}
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.qcow2")
+	overlay := filepath.Join(dir, "overlay.qcow2")
+	if output, err := exec.Command("qemu-img", "create", "-f", "qcow2", base, "10M").CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	if output, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", base, "-F", "qcow2", overlay).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+
+	size := func() int64 {
+		info, err := readImageInfo(nocontext, overlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.VirtualSize
+	}
+
+	// Smaller than the image, left alone
+	if err := growImage(nocontext, overlay, 2*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if size() != 10*1024*1024 {
+		t.Errorf("Image was resized to %d", size())
+	}
+
+	if err := growImage(nocontext, overlay, 20*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if size() != 20*1024*1024 {
+		t.Errorf("Image was not grown, size %d", size())
+	}
+}
+
+func TestStartWithPort_OtherFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	// Fails to bind the port the first time, then fails for
+	// another reason
+	script := filepath.Join(dir, "run.sh")
+	attempts := filepath.Join(dir, "attempts")
+	os.WriteFile(script, []byte(`#!/bin/sh
+echo x >> `+attempts+`
+if [ "$(wc -l < `+attempts+`)" -eq 1 ]; then
+    echo "qemu: -netdev user: Could not set up host forwarding rule" >&2
+else
+    echo "Could not access KVM kernel module: No such file or directory" >&2
+fi
+exit 1
+`), 0755)
+
+	console, err := newConsoleLog(filepath.Join(dir, "console.log"), CONSOLE_LOG_MAX_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer console.close()
+	m := &qemuMachine{
+		id:          "test",
+		config:      MachineConfig{Script: script},
+		driver:      &qemuDriver{stateDir: dir},
+		record:      newMachineRecord("test", 0),
+		ports:       newPortAllocator(),
+		qmpSocket:   filepath.Join(dir, "qmp.sock"),
+		readySocket: filepath.Join(dir, "ready.sock"),
+		console:     console,
+	}
+	m.config.Readiness.timeout = time.Minute
+
+	err = m.startWithPort(nocontext)
+	if err == nil || err == errPortInUse {
+		t.Fatalf("Expected the second failure to be reported, got %v", err)
+	}
+	data, _ := os.ReadFile(attempts)
+	if n := strings.Count(string(data), "x"); n != 2 {
+		t.Errorf("Expected 2 attempts, got %d", n)
+	}
+	if strings.Contains(console.tail(), "host forwarding") {
+		t.Errorf("Tail has the output of the previous attempt: %q", console.tail())
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// launchParams are the per-build parameters of a machine, given to
+// Qemu on the command line or to the script in its environment.
+type launchParams struct {
+	Image       string
+	SeedImage   string
+	SSHPort     int
+	QMPSocket   string
+	ReadySocket string
+
+	// Private network joining the machines of the pipeline, if
+	// there are several
+	LAN *lanConfig
+
+	// Network policy, and the endpoints it allows
+	Network   string
+	Endpoints []Endpoint
+}
+
+// environ returns the environment variables given to the script.
+func (p launchParams) environ(config MachineConfig) []string {
+	env := []string{
+		"QEMU_IMAGE=" + p.Image,
+		"QEMU_SSH_PORT=" + strconv.Itoa(p.SSHPort),
+		"QEMU_SEED_IMAGE=" + p.SeedImage,
+		"QEMU_QMP_SOCKET=" + p.QMPSocket,
+		"QEMU_READY_SOCKET=" + p.ReadySocket,
+		"QEMU_MEMORY=" + strconv.Itoa(config.Memory),
+		"QEMU_SMP=" + strconv.Itoa(config.SMP),
+		"QEMU_NETWORK=" + p.Network,
+		"QEMU_NETDEV_OPTIONS=" + networkOptions(p.Network, p.Endpoints),
+	}
+	if p.LAN != nil {
+		env = append(env,
+			"QEMU_LAN_NETDEV="+p.LAN.netdev("lan"),
+			"QEMU_LAN_MAC="+p.LAN.MAC,
+		)
+	}
+	return env
+}
+
+// qemuCommand returns the command line running the machine
+// described by the config.
+func qemuCommand(config MachineConfig, params launchParams) []string {
+	args := []string{config.Binary}
+
+	if config.Machine != "" {
+		args = append(args, "-machine", config.Machine)
+	}
+	args = append(args, "-accel", config.Accel)
+	args = append(args, "-cpu", config.CPU)
+	args = append(args, "-m", strconv.Itoa(config.Memory))
+	args = append(args, "-smp", strconv.Itoa(config.SMP))
+	if config.Firmware != "" {
+		args = append(args, "-bios", config.Firmware)
+	}
+	args = append(args, "-no-reboot")
+
+	// Disks
+	args = append(args, "-drive", "id=root,file="+escapeOption(params.Image)+",format=qcow2,if=virtio")
+	if isPC(config.Arch) {
+		args = append(args, "-drive", "id=cidata,file="+escapeOption(params.SeedImage)+",media=cdrom")
+	} else {
+		// Other machines have no IDE controller for the CD-ROM
+		args = append(args, "-drive", "id=cidata,file="+escapeOption(params.SeedImage)+",format=raw,if=virtio,readonly=on")
+	}
+	for i, disk := range config.Disks {
+		drive := fmt.Sprintf(
+			"id=disk%d,file=%s,format=%s,if=%s",
+			i, escapeOption(disk.File), disk.Format, disk.Interface,
+		)
+		if disk.ReadOnly {
+			drive += ",readonly=on"
+		}
+		args = append(args, "-drive", drive)
+	}
+
+	// Network, forwarding SSH to the first interface, and limited
+	// by the policy
+	for i, nic := range config.NICs {
+		netdev := fmt.Sprintf("user,id=net%d", i)
+		if i == 0 {
+			netdev += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:22", params.SSHPort)
+		}
+		options := nic.Options
+		if RestrictsNetwork(params.Network) {
+			options = stripNetworkOptions(options)
+		}
+		if options != "" {
+			netdev += "," + options
+		}
+		netdev += networkOptions(params.Network, params.Endpoints)
+		args = append(args, "-netdev", netdev)
+		args = append(args, "-device", fmt.Sprintf("%s,netdev=net%d", nic.Model, i))
+	}
+
+	// Private network, on the model of the first interface
+	if params.LAN != nil {
+		model := "virtio-net-pci"
+		if len(config.NICs) > 0 {
+			model = config.NICs[0].Model
+		}
+		args = append(args, "-netdev", params.LAN.netdev("lan"))
+		args = append(args, "-device", fmt.Sprintf("%s,netdev=lan,mac=%s", model, params.LAN.MAC))
+	}
+
+	// Readiness port
+	args = append(args, "-device", "virtio-serial-pci")
+	args = append(args, "-chardev", "socket,id=ready,path="+escapeOption(params.ReadySocket)+",server=on,wait=off")
+	args = append(args, "-device", "virtserialport,chardev=ready,name="+READY_PORT_NAME)
+
+	// Report guest panics over QMP
+	if isPC(config.Arch) {
+		args = append(args, "-device", "pvpanic")
+	}
+
+	args = append(args, "-qmp", "unix:"+escapeOption(params.QMPSocket)+",server=on,wait=off")
+	args = append(args, "-nographic", "-vga", "none", "-display", "none")
+
+	args = append(args, config.ExtraArgs...)
+	return args
+}
+
+// isPC returns true for the architectures of the PC machine types.
+func isPC(arch string) bool {
+	return arch == "x86_64" || arch == "i386"
+}
+
+// escapeOption escapes a value for use in a comma-separated Qemu
+// option list.
+func escapeOption(value string) string {
+	escaped := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == ',' {
+			escaped = append(escaped, ',')
+		}
+		escaped = append(escaped, value[i])
+	}
+	return string(escaped)
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQemuCommand(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{
+		"memory": 4096,
+		"disks": [{"file": "data.img", "read_only": true}],
+		"nics": [{}, {"model": "e1000", "options": "restrict=on"}],
+		"extra_args": ["-rtc", "base=utc"]
+	}`), 0644)
+	config, err := loadMachineConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Script != "" {
+		t.Errorf("Unexpected script %q", config.Script)
+	}
+
+	args := qemuCommand(config, launchParams{
+		Image:       "/tmp/a,b.qcow2",
+		SeedImage:   "/tmp/seed.iso",
+		SSHPort:     2222,
+		QMPSocket:   "/tmp/q,mp.sock",
+		ReadySocket: "/tmp/ready.sock",
+	})
+	command := strings.Join(args, " ")
+	for _, expected := range []string{
+		"qemu-system-x86_64 ",
+		" -accel kvm -cpu host -m 4096 -smp 2 ",
+		" -drive id=root,file=/tmp/a,,b.qcow2,format=qcow2,if=virtio ",
+		" -drive id=cidata,file=/tmp/seed.iso,media=cdrom ",
+		" -drive id=disk0,file=" + filepath.Join(dir, "data.img") + ",format=raw,if=virtio,readonly=on ",
+		" -netdev user,id=net0,hostfwd=tcp:127.0.0.1:2222-:22 -device virtio-net-pci,netdev=net0 ",
+		" -netdev user,id=net1,restrict=on -device e1000,netdev=net1 ",
+		" -chardev socket,id=ready,path=/tmp/ready.sock,server=on,wait=off ",
+		" -device pvpanic ",
+		" -qmp unix:/tmp/q,,mp.sock,server=on,wait=off ",
+		" -rtc base=utc",
+	} {
+		if !strings.Contains(command, expected) {
+			t.Errorf("Expected %q in command line:\n%s", expected, command)
+		}
+	}
+	if !strings.HasSuffix(command, " -rtc base=utc") {
+		t.Errorf("Extra arguments are not last:\n%s", command)
+	}
+}
+
+func TestQemuCommand_LAN(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{
+		"nics": [{"model": "e1000"}]
+	}`), 0644)
+	config, err := loadMachineConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lan := &lanConfig{Group: "239.255.1.2:12345", MAC: "52:54:01:00:00:0a"}
+	args := qemuCommand(config, launchParams{LAN: lan})
+	command := strings.Join(args, " ")
+	expected := " -netdev socket,id=lan,mcast=239.255.1.2:12345,localaddr=127.0.0.1 -device e1000,netdev=lan,mac=52:54:01:00:00:0a "
+	if !strings.Contains(command, expected) {
+		t.Errorf("Expected %q in command line:\n%s", expected, command)
+	}
+
+	env := strings.Join(launchParams{LAN: lan}.environ(config), "\n")
+	if !strings.Contains(env, "\nQEMU_LAN_NETDEV=socket,id=lan,mcast=239.255.1.2:12345,localaddr=127.0.0.1\nQEMU_LAN_MAC=52:54:01:00:00:0a") {
+		t.Errorf("Unexpected environment:\n%s", env)
+	}
+}
+
+func TestQemuCommand_Emulated(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{
+		"arch": "aarch64",
+		"accel": "tcg",
+		"machine": "virt",
+		"firmware": "/usr/share/AAVMF/AAVMF_CODE.fd"
+	}`), 0644)
+	config, err := loadMachineConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := qemuCommand(config, launchParams{})
+	command := strings.Join(args, " ")
+	for _, expected := range []string{
+		"qemu-system-aarch64 -machine virt -accel tcg -cpu max ",
+		" -bios /usr/share/AAVMF/AAVMF_CODE.fd ",
+	} {
+		if !strings.Contains(command, expected) {
+			t.Errorf("Expected %q in command line:\n%s", expected, command)
+		}
+	}
+	if strings.Contains(command, "pvpanic") {
+		t.Errorf("Unexpected pvpanic device on aarch64")
+	}
+}
+
+func TestQemuCommand_ForeignArch(t *testing.T) {
+	dir := t.TempDir()
+	arch := "aarch64"
+	if hostArch() == "aarch64" {
+		arch = "riscv64"
+	}
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{"arch": "`+arch+`"}`), 0644)
+	config, err := loadMachineConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Accel != "tcg" || config.CPU != "max" || config.Machine != "virt" {
+		t.Errorf("Unexpected defaults %q %q %q", config.Accel, config.CPU, config.Machine)
+	}
+	if arch == "aarch64" && config.Firmware != AARCH64_FIRMWARE {
+		t.Errorf("Unexpected firmware %q", config.Firmware)
+	}
+	args := qemuCommand(config, launchParams{SeedImage: "/tmp/seed.iso"})
+	command := strings.Join(args, " ")
+	if !strings.Contains(command, " -drive id=cidata,file=/tmp/seed.iso,format=raw,if=virtio,readonly=on ") {
+		t.Errorf("Expected the seed on a virtio disk:\n%s", command)
+	}
+}
+
+func TestLoadMachineConfig_Script(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{}`), 0644)
+	os.WriteFile(filepath.Join(dir, "test.qemu.sh"), []byte("#!/bin/sh\n"), 0755)
+	config, err := loadMachineConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Script != filepath.Join(dir, "test.qemu.sh") {
+		t.Errorf("Expected the image's script, got %q", config.Script)
+	}
+
+	env := launchParams{SSHPort: 2222}.environ(config)
+	if env[1] != "QEMU_SSH_PORT=2222" || env[5] != "QEMU_MEMORY=1024" {
+		t.Errorf("Unexpected environment %v", env)
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	config := MachineConfig{Memory: 1024, SMP: 2}
+	config.applySettings(Settings{})
+	if config.Memory != 1024 || config.SMP != 2 {
+		t.Errorf("Defaults were changed: %d MiB, %d cpus", config.Memory, config.SMP)
+	}
+
+	config.applySettings(Settings{CPUs: 8, Memory: 3*1024*1024*1024 + 1})
+	if config.SMP != 8 {
+		t.Errorf("Expected 8 cpus, got %d", config.SMP)
+	}
+	if config.Memory != 3073 {
+		t.Errorf("Expected memory rounded up to 3073 MiB, got %d", config.Memory)
+	}
+}
+
+func TestApplySettings_DiskSize(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{"disk_size": "10GiB"}`), 0644)
+	config, err := loadMachineConfig(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.diskSize != 10*1024*1024*1024 {
+		t.Fatalf("Unexpected disk size %d", config.diskSize)
+	}
+
+	smaller := config
+	smaller.applySettings(Settings{DiskSize: 1024 * 1024 * 1024})
+	if smaller.diskSize != 10*1024*1024*1024 {
+		t.Errorf("Disk was made smaller than the image asks for")
+	}
+	config.applySettings(Settings{DiskSize: 20 * 1024 * 1024 * 1024})
+	if config.diskSize != 20*1024*1024*1024 {
+		t.Errorf("Disk size from the pipeline was not applied")
+	}
+
+	os.WriteFile(filepath.Join(dir, "test.qemu.json"), []byte(`{"disk_size": "big"}`), 0644)
+	if _, err := loadMachineConfig(dir, "test"); err == nil {
+		t.Errorf("Expected error for invalid disk size")
+	}
+}
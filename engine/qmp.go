@@ -0,0 +1,168 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// qmpClient talks to Qemu over its QEMU Machine Protocol socket.
+type qmpClient struct {
+	conn    net.Conn
+	encoder *json.Encoder
+
+	// Commands are answered in order, one at a time
+	mu        sync.Mutex
+	responses chan qmpMessage
+
+	// Asynchronous events sent by Qemu, closed when the
+	// connection ends
+	events chan qmpEvent
+}
+
+// qmpMessage is any message sent by Qemu.
+type qmpMessage struct {
+	QMP    json.RawMessage `json:"QMP,omitempty"`
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *qmpError       `json:"error,omitempty"`
+	Event  string          `json:"event,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// qmpError is the error returned by a failed command.
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// qmpEvent is an event such as SHUTDOWN or GUEST_PANICKED.
+type qmpEvent struct {
+	Event string
+	Data  json.RawMessage
+}
+
+// qmpStatus is the result of query-status.
+type qmpStatus struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// dialQMP connects to a QMP socket and negotiates capabilities.
+func dialQMP(ctx context.Context, socket string) (*qmpClient, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &qmpClient{
+		conn:      conn,
+		encoder:   json.NewEncoder(conn),
+		responses: make(chan qmpMessage, 1),
+		events:    make(chan qmpEvent, 16),
+	}
+
+	// Read the greeting before anything else
+	decoder := json.NewDecoder(conn)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	var greeting qmpMessage
+	if err := decoder.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("couldn't read QMP greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, errors.New("unexpected QMP greeting")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go c.read(decoder)
+
+	if _, err := c.execute(ctx, "qmp_capabilities", nil); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// read dispatches the messages coming from Qemu.
+func (c *qmpClient) read(decoder *json.Decoder) {
+	defer close(c.events)
+	defer close(c.responses)
+	for {
+		var msg qmpMessage
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Event != "" {
+			select {
+			case c.events <- qmpEvent{Event: msg.Event, Data: msg.Data}:
+			default:
+				// Nobody is listening, drop it
+			}
+			continue
+		}
+		c.responses <- msg
+	}
+}
+
+// execute runs a command and returns its result.
+func (c *qmpClient) execute(ctx context.Context, command string, arguments interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	request := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	if err := c.encoder.Encode(request); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-c.responses:
+		if !ok {
+			return nil, errors.New("QMP connection closed")
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Return, nil
+	case <-ctx.Done():
+		// The response would be mistaken for the next one's
+		c.conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// status queries the run state of the machine.
+func (c *qmpClient) status(ctx context.Context) (*qmpStatus, error) {
+	data, err := c.execute(ctx, "query-status", nil)
+	if err != nil {
+		return nil, err
+	}
+	var status qmpStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// close terminates the connection.
+func (c *qmpClient) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// startTestQMPServer serves a QMP socket that answers a few
+// commands, like Qemu would.
+func startTestQMPServer(t *testing.T) (string, chan string) {
+	socket := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	commands := make(chan string, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}}, "capabilities": []}}`)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var request struct {
+				Execute string `json:"execute"`
+			}
+			json.Unmarshal(scanner.Bytes(), &request)
+			commands <- request.Execute
+			switch request.Execute {
+			case "qmp_capabilities":
+				fmt.Fprintln(conn, `{"return": {}}`)
+			case "query-status":
+				fmt.Fprintln(conn, `{"return": {"status": "running", "singlestep": false, "running": true}}`)
+			case "system_powerdown":
+				fmt.Fprintln(conn, `{"return": {}}`)
+				fmt.Fprintln(conn, `{"timestamp": {"seconds": 1, "microseconds": 2}, "event": "POWERDOWN"}`)
+				fmt.Fprintln(conn, `{"timestamp": {"seconds": 1, "microseconds": 3}, "event": "SHUTDOWN", "data": {"guest": true, "reason": "guest-shutdown"}}`)
+			default:
+				fmt.Fprintln(conn, `{"error": {"class": "CommandNotFound", "desc": "The command was not found"}}`)
+			}
+		}
+	}()
+	return socket, commands
+}
+
+func TestQMP(t *testing.T) {
+	socket, commands := startTestQMPServer(t)
+	client, err := dialQMP(nocontext, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+	if cmd := <-commands; cmd != "qmp_capabilities" {
+		t.Errorf("Expected capabilities negotiation, got %q", cmd)
+	}
+
+	status, err := client.status(nocontext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Running || status.Status != "running" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	_, err = client.execute(nocontext, "nonexistent", nil)
+	if qmpErr, ok := err.(*qmpError); !ok || qmpErr.Class != "CommandNotFound" {
+		t.Errorf("Expected CommandNotFound error, got %v", err)
+	}
+
+	if _, err := client.execute(nocontext, "system_powerdown", nil); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for event := range client.events {
+		events = append(events, event.Event)
+		if event.Event == "SHUTDOWN" {
+			break
+		}
+	}
+	if len(events) != 2 || events[0] != "POWERDOWN" {
+		t.Errorf("Unexpected events %v", events)
+	}
+}
+
+func TestQMP_NotQMP(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			fmt.Fprintln(conn, `{"hello": "world"}`)
+			conn.Close()
+		}
+	}()
+	if _, err := dialQMP(nocontext, socket); err == nil {
+		t.Errorf("Expected error on bad greeting")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Readiness methods
+const (
+	// The guest writes a token to a virtio-serial port once
+	// cloud-init is done, after which SSH is probed. SSH is only
+	// probed before that if the port is not set up by the
+	// script, or if the guest closes it or never writes to it
+	ReadinessVirtioSerial = "virtio-serial"
+
+	// Only probe the SSH server
+	ReadinessSSH = "ssh"
+)
+
+// Name of the virtio-serial port the guest writes to
+const READY_PORT_NAME = "org.drone.ready"
+
+const READY_CONNECT_DELAY time.Duration = 10 * time.Second
+
+// How long SSH is still probed after the readiness signal timed out
+const READY_GRACE_DELAY time.Duration = 30 * time.Second
+
+const SSH_PROBE_MIN_DELAY time.Duration = 250 * time.Millisecond
+
+const SSH_PROBE_MAX_DELAY time.Duration = 5 * time.Second
+
+var errNoReadySocket = errors.New("readiness socket is not available")
+
+// ReadinessConfig configures how the engine waits for the machine
+// to boot.
+type ReadinessConfig struct {
+	Method  string `json:"method,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+
+	timeout time.Duration
+}
+
+// readyCommand returns the shell command the guest runs to signal
+// that it is ready.
+func readyCommand(token string) string {
+	return "echo " + token + " > /dev/virtio-ports/" + READY_PORT_NAME
+}
+
+// waitReadySignal waits for the guest to write the token to the
+// readiness socket. It returns errNoReadySocket if the socket
+// doesn't show up, meaning the script doesn't set up the port.
+func waitReadySignal(ctx context.Context, socket string, token string) error {
+	deadline := time.Now().Add(READY_CONNECT_DELAY)
+	var conn net.Conn
+	for {
+		var err error
+		dialer := net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "unix", socket)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errNoReadySocket
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == token {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("readiness socket closed")
+}
+
+// waitBoot waits until the machine accepts SSH connections. It
+// returns early with an error if the context is cancelled, which
+// happens when Qemu exits.
+func (m *qemuMachine) waitBoot(ctx context.Context) error {
+	readiness := m.config.Readiness
+	deadline := time.Now().Add(readiness.timeout)
+
+	// Wait for the signal before connecting, since SSH usually
+	// comes up before cloud-init is done running commands. Only
+	// probe SSH right away if the port is not set up
+	if readiness.Method == ReadinessVirtioSerial {
+		signalCtx, cancel := context.WithDeadline(ctx, deadline)
+		err := waitReadySignal(signalCtx, m.readySocket, m.readyToken)
+		cancel()
+		if err == nil {
+			logrus.Debug("machine signaled readiness")
+		} else if ctx.Err() != nil {
+			return errors.New("machine did not come online")
+		} else if err == errNoReadySocket {
+			logrus.Info("no readiness socket, probing SSH")
+		} else if err == context.DeadlineExceeded {
+			// Give SSH a last chance, the guest might not write
+			// the token
+			logrus.Warn("no readiness signal before timeout, probing SSH; set the readiness method to ssh if the image can't send it")
+			deadline = time.Now().Add(READY_GRACE_DELAY)
+		} else {
+			logrus.WithError(err).Info("no readiness signal, probing SSH")
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	// Try to connect via SSH until it succeeds, waiting longer
+	// each time
+	delay := SSH_PROBE_MIN_DELAY
+	for {
+		err := m.connect(ctx)
+		if err == nil {
+			return nil
+		}
+		logrus.Infof("connection failing: %v", err)
+
+		// Give up early if the machine won't run anymore
+		if status := m.status(); status != nil && !status.Running && status.Status != "prelaunch" {
+			logrus.WithFields(logrus.Fields{
+				"status": status.Status,
+			}).Warn("machine is not running")
+			return errors.New("machine is " + status.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.New("machine did not come online")
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > SSH_PROBE_MAX_DELAY {
+			delay = SSH_PROBE_MAX_DELAY
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaitReadySignal(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ready.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, "wrongtoken")
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintln(conn, "thetoken")
+		time.Sleep(time.Second)
+	}()
+
+	ctx, cancel := context.WithTimeout(nocontext, 5*time.Second)
+	defer cancel()
+	if err := waitReadySignal(ctx, socket, "thetoken"); err != nil {
+		t.Errorf("Expected readiness, got %v", err)
+	}
+}
+
+func TestWaitReadySignal_Timeout(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ready.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(nocontext, 100*time.Millisecond)
+	defer cancel()
+	if err := waitReadySignal(ctx, socket, "thetoken"); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestLoadMachineConfig_Readiness(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		err := os.WriteFile(filepath.Join(dir, name+".qemu.json"), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("default", `{}`)
+	config, err := loadMachineConfig(dir, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Readiness.Method != ReadinessVirtioSerial {
+		t.Errorf("Unexpected default method %q", config.Readiness.Method)
+	}
+	if config.Readiness.timeout != BOOT_MAX_DELAY {
+		t.Errorf("Unexpected default timeout %v", config.Readiness.timeout)
+	}
+
+	write("ssh", `{"readiness": {"method": "ssh", "timeout": "30s"}}`)
+	config, err = loadMachineConfig(dir, "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Readiness.Method != ReadinessSSH || config.Readiness.timeout != 30*time.Second {
+		t.Errorf("Unexpected readiness %+v", config.Readiness)
+	}
+
+	write("badmethod", `{"readiness": {"method": "carrier-pigeon"}}`)
+	if _, err := loadMachineConfig(dir, "badmethod"); err == nil {
+		t.Errorf("Expected error for invalid method")
+	}
+
+	write("badtimeout", `{"readiness": {"timeout": "soon"}}`)
+	if _, err := loadMachineConfig(dir, "badtimeout"); err == nil {
+		t.Errorf("Expected error for invalid timeout")
+	}
+}
+
+// newBootingMachine returns a machine whose SSH server is the test
+// server, waiting for the readiness signal on a socket.
+func newBootingMachine(t *testing.T, server *testSSHServer) *qemuMachine {
+	_, port, _ := net.SplitHostPort(server.addr())
+	m := &qemuMachine{
+		config:      MachineConfig{Readiness: ReadinessConfig{Method: ReadinessVirtioSerial, timeout: time.Minute}},
+		readySocket: filepath.Join(t.TempDir(), "ready.sock"),
+		readyToken:  "thetoken",
+		sshConfig:   server.clientConfig(),
+	}
+	fmt.Sscan(port, &m.sshPort)
+	return m
+}
+
+func TestWaitBoot_Signal(t *testing.T) {
+	server := startTestSSHServer(t)
+	m := newBootingMachine(t, server)
+
+	// The guest only writes the token after a while
+	listener, err := net.Listen("unix", m.readySocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+			fmt.Fprintln(conn, "thetoken")
+			time.Sleep(time.Second)
+		}
+	}()
+
+	start := time.Now()
+	if err := m.waitBoot(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	defer m.transport.close()
+	if time.Since(start) < time.Second {
+		t.Errorf("SSH was probed before the signal, took %s", time.Since(start))
+	}
+}
+
+func TestWaitBoot_SocketClosed(t *testing.T) {
+	server := startTestSSHServer(t)
+	m := newBootingMachine(t, server)
+
+	// The socket exists but the guest closes it without writing
+	listener, err := net.Listen("unix", m.readySocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	if err := m.waitBoot(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	defer m.transport.close()
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("SSH was not probed after the socket closed, took %s", time.Since(start))
+	}
+}
+
+func TestWaitBoot_SignalTimeout(t *testing.T) {
+	server := startTestSSHServer(t)
+	m := newBootingMachine(t, server)
+	m.config.Readiness.timeout = 500 * time.Millisecond
+
+	// The socket exists but the guest never writes to it
+	listener, err := net.Listen("unix", m.readySocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(10 * time.Second)
+		}
+	}()
+
+	if err := m.waitBoot(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	m.transport.close()
+}
+
+func TestWaitBoot_NoSocket(t *testing.T) {
+	server := startTestSSHServer(t)
+	m := newBootingMachine(t, server)
+
+	if err := m.waitBoot(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	m.transport.close()
+}
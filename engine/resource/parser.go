@@ -37,8 +37,38 @@ func match(r *manifest.RawResource) bool {
 }
 
 func lint(pipeline *Pipeline) error {
+	// ensure pipeline machines are unique.
+	machines := map[string]struct{}{}
+	for _, machine := range pipeline.Machines {
+		if machine == nil {
+			return errors.New("Linter: detected nil machine")
+		}
+		if machine.Name == "" {
+			return errors.New("Linter: invalid or missing machine name")
+		}
+		if _, ok := machines[machine.Name]; ok {
+			return errors.New("Linter: duplicate machine name")
+		}
+		machines[machine.Name] = struct{}{}
+	}
+
 	// ensure pipeline steps are not unique.
 	names := map[string]struct{}{}
+	for _, service := range pipeline.Services {
+		if service == nil {
+			return errors.New("Linter: detected nil service")
+		}
+		if service.Name == "" {
+			return errors.New("Linter: invalid or missing service name")
+		}
+		if len(service.Name) > 100 {
+			return errors.New("Linter: service name cannot exceed 100 characters")
+		}
+		if _, ok := names[service.Name]; ok {
+			return errors.New("Linter: duplicate service name")
+		}
+		names[service.Name] = struct{}{}
+	}
 	for _, step := range pipeline.Steps {
 		if step == nil {
 			return errors.New("Linter: detected nil step")
@@ -41,6 +41,11 @@ func TestParse(t *testing.T) {
 			Workspace: Workspace{
 				Path: "/drone/src",
 			},
+			VM: VM{
+				CPUs:     4,
+				Memory:   2 * 1024 * 1024 * 1024,
+				DiskSize: 20 * 1024 * 1024 * 1024,
+			},
 			Platform: manifest.Platform{
 				OS:   "linux",
 				Arch: "arm64",
@@ -53,6 +58,29 @@ func TestParse(t *testing.T) {
 					Include: []string{"master"},
 				},
 			},
+			Machines: []*Machine{
+				{
+					Name: "client",
+				},
+				{
+					Name:  "server",
+					Image: "fedora-40",
+					VM: VM{
+						Memory: 4 * 1024 * 1024 * 1024,
+					},
+				},
+			},
+			Services: []*Service{
+				{
+					Name:     "database",
+					Machine:  "server",
+					Commands: []string{"redis-server"},
+					Probe: &Probe{
+						Port:    6379,
+						Timeout: 30,
+					},
+				},
+			},
 			Steps: []*Step{
 				{
 					Name:      "build",
@@ -67,6 +95,7 @@ func TestParse(t *testing.T) {
 						"GOARCH": &manifest.Variable{Value: "arm64"},
 					},
 					Failure:      "ignore",
+					Machine:      "client",
 					When: manifest.Conditions{
 						Event: manifest.Condition{
 							Include: []string{"push"},
@@ -166,4 +195,22 @@ func TestLint(t *testing.T) {
 	if err := lint(p); err == nil {
 		t.Errorf("Expect error when empty name")
 	}
+
+	p.Services = []*Service{
+		{Name: "build"},
+	}
+	p.Steps = []*Step{
+		{Name: "build"},
+	}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when service and step have the same name")
+	}
+	p.Services = nil
+	p.Machines = []*Machine{
+		{Name: "client"},
+		{Name: "client"},
+	}
+	if err := lint(p); err == nil {
+		t.Errorf("Expect error when duplicate machine name")
+	}
 }
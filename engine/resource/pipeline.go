@@ -35,8 +35,19 @@ type Pipeline struct {
 	Trigger     manifest.Conditions  `json:"conditions,omitempty"`
 
 	Image		string `json:"image,omitempty"`
+	VM			VM     `json:"vm,omitempty"`
+
+	// Network is the network policy of the guests: none,
+	// restricted or full
+	Network string `json:"network,omitempty"`
+
+	// Debug keeps the machines running for a while if a step
+	// fails, so they can be inspected over SSH
+	Debug bool `json:"debug,omitempty"`
 
 	Environment map[string]string `json:"environment,omitempty"`
+	Machines    []*Machine        `json:"machines,omitempty"`
+	Services    []*Service        `json:"services,omitempty"`
 	Steps       []*Step           `json:"steps,omitempty"`
 	Workspace   Workspace         `json:"workspace,omitempty"`
 }
@@ -87,12 +98,50 @@ type (
 		DependsOn    []string                       `json:"depends_on,omitempty" yaml:"depends_on"`
 		Environment  map[string]*manifest.Variable  `json:"environment,omitempty"`
 		Failure      string                         `json:"failure,omitempty"`
+		Machine      string                         `json:"machine,omitempty"`
 		Name         string                         `json:"name,omitempty"`
 		Shell        string                         `json:"shell,omitempty"`
 		When         manifest.Conditions            `json:"when,omitempty"`
 		WorkingDir   string                         `json:"working_dir,omitempty" yaml:"working_dir"`
 	}
 
+	// Service defines a long-running helper, such as a
+	// database, started in the background before the steps.
+	Service struct {
+		Commands    []string                      `json:"commands,omitempty"`
+		Environment map[string]*manifest.Variable `json:"environment,omitempty"`
+		Machine     string                        `json:"machine,omitempty"`
+		Name        string                        `json:"name,omitempty"`
+		Probe       *Probe                        `json:"probe,omitempty"`
+		WorkingDir  string                        `json:"working_dir,omitempty" yaml:"working_dir"`
+	}
+
+	// Probe defines how to tell that a service is ready,
+	// either a TCP port accepting connections or a command
+	// exiting successfully.
+	Probe struct {
+		Port    int    `json:"port,omitempty"`
+		Command string `json:"command,omitempty"`
+		Timeout int    `json:"timeout,omitempty"`
+	}
+
+	// Machine defines one of several virtual machines running
+	// the pipeline, on a private network where its name is its
+	// hostname. The image and resources default to the
+	// pipeline's.
+	Machine struct {
+		Name  string `json:"name,omitempty"`
+		Image string `json:"image,omitempty"`
+		VM    VM     `json:"vm,omitempty"`
+	}
+
+	// VM represents the resources of the virtual machine.
+	VM struct {
+		CPUs     int                `json:"cpus,omitempty"`
+		Memory   manifest.BytesSize `json:"memory,omitempty"`
+		DiskSize manifest.BytesSize `json:"disk_size,omitempty" yaml:"disk_size"`
+	}
+
 	// Workspace represents the pipeline workspace configuration.
 	Workspace struct {
 		Path string `json:"path,omitempty"`
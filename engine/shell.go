@@ -0,0 +1,49 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+// shell builds the commands run on the machine, for the operating
+// system of the guest.
+type shell interface {
+	// makeDirectories returns a command creating the directories
+	// the files are uploaded to.
+	makeDirectories(files []*File) string
+
+	// step returns the command running a step, and files to
+	// upload before running it.
+	step(root string, step *Step, envs map[string]string) (string, []*File)
+
+	// remoteFile returns a file as it is uploaded over SFTP.
+	remoteFile(file *File) *File
+
+	// detach returns the commands running a step command in the
+	// background, keeping its state in dir.
+	detach(dir string, command string) (detachedCommands, error)
+}
+
+// getShell returns the shell for the pipeline's platform.
+func getShell(os string) shell {
+	switch os {
+	case "windows":
+		return powershellShell{}
+	default:
+		return posixShell{}
+	}
+}
+
+// posixShell runs commands through a POSIX shell.
+type posixShell struct{}
+
+func (posixShell) makeDirectories(files []*File) string {
+	return getMakeDirectoriesCommand(files)
+}
+
+func (posixShell) step(root string, step *Step, envs map[string]string) (string, []*File) {
+	return getStepCommand(step.Command, step.Args, envs, step.WorkingDir), nil
+}
+
+func (posixShell) remoteFile(file *File) *File {
+	return file
+}
@@ -6,6 +6,7 @@ package engine
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/drone/runner-go/environ"
 	"github.com/drone/runner-go/pipeline/runtime"
@@ -21,11 +22,34 @@ type (
 		Settings Settings `json:"settings,omitempty"`
 		Files    []*File  `json:"files,omitempty"`
 		Steps    []*Step  `json:"steps,omitempty"`
+
+		// Machines run the pipeline together, on a private
+		// network. If there are none, a single machine with
+		// the pipeline's settings does.
+		Machines []*MachineSpec `json:"machines,omitempty"`
+
+		// Debug keeps the machines running for a while if a
+		// step fails, so they can be inspected over SSH.
+		Debug bool `json:"debug,omitempty"`
+	}
+
+	// MachineSpec is one of the machines of a pipeline, known
+	// by its name on their network.
+	MachineSpec struct {
+		Name     string   `json:"name,omitempty"`
+		Settings Settings `json:"settings,omitempty"`
 	}
 
 	// Settings provides pipeline settings.
 	Settings struct {
-		Image string `json:"image,omitempty"`
+		Image    string `json:"image,omitempty"`
+		OS       string `json:"os,omitempty"`
+		Arch     string `json:"arch,omitempty"`
+		CPUs     int    `json:"cpus,omitempty"`
+		Memory   int64  `json:"memory,omitempty"`
+		DiskSize int64  `json:"disk_size,omitempty"`
+		Network  string `json:"network,omitempty"`
+		BuildID  int64  `json:"build_id,omitempty"`
 	}
 
 	// Step defines a pipeline step.
@@ -37,12 +61,22 @@ type (
 		ErrPolicy    runtime.ErrPolicy `json:"err_policy,omitempty"`
 		Envs         map[string]string `json:"environment,omitempty"`
 		Files        []*File           `json:"files,omitempty"`
+		Machine      string            `json:"machine,omitempty"`
 		Name         string            `json:"name,omitempt"`
+		Probe        *Probe            `json:"probe,omitempty"`
 		RunPolicy    runtime.RunPolicy `json:"run_policy,omitempty"`
 		Secrets      []*Secret         `json:"secrets,omitempty"`
 		WorkingDir   string            `json:"working_dir,omitempty"`
 	}
 
+	// Probe tells when a detached step is ready. The steps
+	// that depend on it wait until it is.
+	Probe struct {
+		Port    int           `json:"port,omitempty"`
+		Command string        `json:"command,omitempty"`
+		Timeout time.Duration `json:"timeout,omitempty"`
+	}
+
 	// Secret represents a secret variable.
 	Secret struct {
 		Name string `json:"name,omitempty"`
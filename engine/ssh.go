@@ -0,0 +1,191 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const SSH_CONNECT_TIMEOUT time.Duration = 2 * time.Second
+
+// sshTransport is a single SSH connection to a machine. Commands
+// and file uploads are multiplexed over it as separate channels.
+type sshTransport struct {
+	client *ssh.Client
+
+	mu   sync.Mutex
+	sftp *sftp.Client
+}
+
+// dialSSH opens an SSH connection to the given address.
+func dialSSH(ctx context.Context, addr string, config *ssh.ClientConfig) (*sshTransport, error) {
+	ctx, cancel := context.WithTimeout(ctx, SSH_CONNECT_TIMEOUT)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SSH handshake doesn't take a context, so bound it
+	// with a deadline on the connection instead
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &sshTransport{
+		client: ssh.NewClient(c, chans, reqs),
+	}, nil
+}
+
+// lockedWriter serializes writes from the stdout and stderr
+// streams of a session, which are copied concurrently.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// run executes a command, streaming its output, and returns the
+// remote exit status.
+func (t *sshTransport) run(ctx context.Context, command string, output io.Writer) (int, error) {
+	logrus.WithFields(logrus.Fields{
+		"command": command,
+	}).Debug("running SSH command")
+
+	session, err := t.client.NewSession()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open SSH session: %w", err)
+	}
+	defer session.Close()
+
+	writer := &lockedWriter{w: output}
+	session.Stdout = writer
+	session.Stderr = writer
+
+	if err := session.Start(command); err != nil {
+		return 0, fmt.Errorf("couldn't start command: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return 0, ctx.Err()
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	} else if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// getSFTP returns the SFTP client of the connection, starting
+// the subsystem on first use.
+func (t *sshTransport) getSFTP() (*sftp.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sftp == nil {
+		client, err := sftp.NewClient(t.client)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't start SFTP: %w", err)
+		}
+		t.sftp = client
+	}
+	return t.sftp, nil
+}
+
+// upload writes a file to the machine with its mode.
+func (t *sshTransport) upload(ctx context.Context, file *File) error {
+	client, err := t.getSFTP()
+	if err != nil {
+		return err
+	}
+
+	remote, err := client.OpenFile(file.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	if _, err := remote.Write(file.Data); err != nil {
+		return err
+	}
+	if file.Mode != 0 {
+		if err := remote.Chmod(os.FileMode(file.Mode)); err != nil {
+			return err
+		}
+	}
+	return remote.Close()
+}
+
+// dial opens a connection to a TCP port of the machine, forwarded
+// over SSH.
+func (t *sshTransport) dial(ctx context.Context, port int) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := t.client.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		// Close the connection if it opens after all
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// close terminates the connection.
+func (t *sshTransport) close() error {
+	t.mu.Lock()
+	if t.sftp != nil {
+		t.sftp.Close()
+		t.sftp = nil
+	}
+	t.mu.Unlock()
+	return t.client.Close()
+}
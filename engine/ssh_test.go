@@ -0,0 +1,217 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is an SSH server that runs commands on the local
+// host and serves SFTP, standing in for a virtual machine.
+type testSSHServer struct {
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	hostKey   ssh.Signer
+	clientKey ssh.Signer
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startTestSSHServer(t *testing.T) *testSSHServer {
+	s := &testSSHServer{
+		hostKey:   newTestSigner(t),
+		clientKey: newTestSigner(t),
+	}
+	authorized := s.clientKey.PublicKey().Marshal()
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	s.config.AddHostKey(s.hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testSSHServer) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(s.clientKey)},
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey.PublicKey()),
+	}
+}
+
+func (s *testSSHServer) serve(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+func (s *testSSHServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			length := binary.BigEndian.Uint32(req.Payload)
+			command := string(req.Payload[4 : 4+length])
+			req.Reply(true, nil)
+
+			cmd := exec.Command("/bin/sh", "-c", command)
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			status := uint32(0)
+			if err := cmd.Run(); err != nil {
+				status = 255
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					status = uint32(exitErr.ExitCode())
+				}
+			}
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, status)
+			channel.SendRequest("exit-status", false, payload)
+			return
+		case "subsystem":
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestSSHTransport_Run(t *testing.T) {
+	server := startTestSSHServer(t)
+	transport, err := dialSSH(nocontext, server.addr(), server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.close()
+
+	var output bytes.Buffer
+	exitCode, err := transport.run(nocontext, "echo hello; echo oops >&2; exit 3", &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", exitCode)
+	}
+	if got := output.String(); got != "hello\noops\n" && got != "oops\nhello\n" {
+		t.Errorf("Unexpected output %q", got)
+	}
+
+	// The connection is reused for following commands
+	exitCode, err = transport.run(nocontext, "true", &output)
+	if err != nil || exitCode != 0 {
+		t.Errorf("Expected success, got %d %v", exitCode, err)
+	}
+}
+
+func TestSSHTransport_Upload(t *testing.T) {
+	server := startTestSSHServer(t)
+	transport, err := dialSSH(nocontext, server.addr(), server.clientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.close()
+
+	// Make sure the requested mode isn't masked
+	defer syscall.Umask(syscall.Umask(0))
+
+	target := filepath.Join(t.TempDir(), "script")
+	err = transport.upload(nocontext, &File{
+		Path: target,
+		Mode: 0750,
+		Data: []byte("#!/bin/sh\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Expected mode 0750, got %o", info.Mode().Perm())
+	}
+	data, _ := os.ReadFile(target)
+	if string(data) != "#!/bin/sh\n" {
+		t.Errorf("Unexpected content %q", data)
+	}
+}
+
+func TestSSHTransport_WrongHostKey(t *testing.T) {
+	server := startTestSSHServer(t)
+	config := server.clientConfig()
+	config.HostKeyCallback = ssh.FixedHostKey(newTestSigner(t).PublicKey())
+	_, err := dialSSH(nocontext, server.addr(), config)
+	if err == nil {
+		t.Errorf("Expected host key mismatch to fail")
+	}
+}
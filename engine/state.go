@@ -0,0 +1,214 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Files in the temporary directory that don't belong to any machine
+// are only deleted after this long, in case they are being created
+const ORPHAN_MIN_AGE time.Duration = 10 * time.Minute
+
+// machineRecord is written to the state directory while a machine
+// exists, so that it can be cleaned up if the runner dies.
+type machineRecord struct {
+	ID      string    `json:"id"`
+	BuildID int64     `json:"build_id,omitempty"`
+	Created time.Time `json:"created"`
+
+	// The runner process that owns the machine
+	Owner        int    `json:"owner"`
+	OwnerStarted uint64 `json:"owner_started"`
+
+	// The Qemu process, leader of its process group
+	PID        int    `json:"pid,omitempty"`
+	PIDStarted uint64 `json:"pid_started,omitempty"`
+
+	// The image version the overlay is based on
+	BaseImage string `json:"base_image,omitempty"`
+
+	Port  int      `json:"port,omitempty"`
+	Files []string `json:"files"`
+}
+
+// processStartTime returns when a process started, in clock ticks
+// since boot. Together with the PID, it identifies a process even
+// if PIDs get reused.
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name is in parentheses and can contain spaces
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end == -1 {
+		return 0, errors.New("invalid stat file")
+	}
+	fields := strings.Fields(stat[end+1:])
+	// Field 22 is the start time, fields starts at field 3
+	if len(fields) < 20 {
+		return 0, errors.New("invalid stat file")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// processAlive returns true if the process is still running.
+func processAlive(pid int, started uint64) bool {
+	if pid <= 0 {
+		return false
+	}
+	current, err := processStartTime(pid)
+	return err == nil && current == started
+}
+
+// newMachineRecord returns a record owned by the current process.
+func newMachineRecord(id string, buildID int64) *machineRecord {
+	owner := os.Getpid()
+	ownerStarted, _ := processStartTime(owner)
+	return &machineRecord{
+		ID:           id,
+		BuildID:      buildID,
+		Created:      time.Now(),
+		Owner:        owner,
+		OwnerStarted: ownerStarted,
+	}
+}
+
+func recordPath(stateDir string, id string) string {
+	return path.Join(stateDir, id+".json")
+}
+
+// write saves the record, replacing the previous version.
+func (r *machineRecord) write(stateDir string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	filename := recordPath(stateDir, r.ID)
+	temp := filename + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+func readRecord(filename string) (*machineRecord, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var record machineRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// machineIDFromFile returns the ID of the machine a file in the
+// temporary directory belongs to, or "" if it isn't one of ours.
+// Overlays of older versions were named drone-qemu-<number>.qcow2,
+// for those the number is returned.
+func machineIDFromFile(name string) string {
+	if !strings.HasPrefix(name, "drone-qemu-") {
+		return ""
+	}
+	name = name[len("drone-qemu-"):]
+	if legacy := strings.TrimSuffix(name, ".qcow2"); legacy != name && legacy != "" &&
+		strings.Trim(legacy, "0123456789") == "" {
+		return legacy
+	}
+	if len(name) <= 16 || (name[16] != '.' && name[16] != '-') {
+		return ""
+	}
+	for _, c := range []byte(name[:16]) {
+		if bytes.IndexByte(idChars, c) == -1 {
+			return ""
+		}
+	}
+	return name[:16]
+}
+
+// cleanup kills the processes and deletes the files of machines
+// whose runner is gone, or that the runner has lost track of.
+func (d *qemuDriver) cleanup(ctx context.Context) error {
+	entries, err := os.ReadDir(d.stateDir)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		filename := path.Join(d.stateDir, entry.Name())
+		record, err := readRecord(filename)
+		if err != nil {
+			logrus.WithError(err).WithField("file", filename).Warn("invalid machine record")
+			continue
+		}
+		known[record.ID] = true
+
+		// Leave alone machines that are in use
+		if processAlive(record.Owner, record.OwnerStarted) {
+			if record.Owner != os.Getpid() || d.isLive(record.ID) {
+				continue
+			}
+		}
+
+		log := logrus.WithFields(logrus.Fields{
+			"machine": record.ID,
+			"build":   record.BuildID,
+			"created": record.Created,
+		})
+		if processAlive(record.PID, record.PIDStarted) {
+			log.WithField("pid", record.PID).Warn("killing stale qemu process")
+			syscall.Kill(-record.PID, syscall.SIGKILL)
+		}
+		for _, file := range record.Files {
+			if err := os.Remove(file); err == nil {
+				log.WithField("file", file).Warn("deleted stale file")
+			}
+		}
+		os.Remove(filename)
+		log.Warn("cleaned up stale machine")
+	}
+
+	// Delete files that aren't part of any record, such as those
+	// left by older versions
+	entries, err = os.ReadDir(d.tempDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id := machineIDFromFile(entry.Name())
+		if id == "" || known[id] || d.isLive(id) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ORPHAN_MIN_AGE {
+			continue
+		}
+		filename := path.Join(d.tempDir, entry.Name())
+		if err := os.Remove(filename); err == nil {
+			logrus.WithField("file", filename).Warn("deleted orphaned file")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessAlive(t *testing.T) {
+	started, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !processAlive(os.Getpid(), started) {
+		t.Errorf("Expected current process to be alive")
+	}
+	if processAlive(os.Getpid(), started+1) {
+		t.Errorf("Expected process with another start time to be dead")
+	}
+}
+
+func TestMachineIDFromFile(t *testing.T) {
+	for name, expected := range map[string]string{
+		"drone-qemu-abcdefgh01234567.qcow2":       "abcdefgh01234567",
+		"drone-qemu-abcdefgh01234567-seed.iso":    "abcdefgh01234567",
+		"drone-qemu-abcdefgh01234567-console.log": "abcdefgh01234567",
+		"drone-qemu-5577006791947779410.qcow2":    "5577006791947779410",
+		"drone-qemu-42.qcow2":                     "42",
+		"drone-qemu-42-seed.iso":                  "",
+		"drone-qemu-state":                        "",
+		"drone-qemu-ABCDEFGH01234567.qcow2":       "",
+		"other-abcdefgh01234567.qcow2":            "",
+	} {
+		if got := machineIDFromFile(name); got != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	tempDir := t.TempDir()
+	stateDir := filepath.Join(tempDir, "drone-qemu-state")
+	os.Mkdir(stateDir, 0700)
+	d := &qemuDriver{
+		tempDir:  tempDir,
+		stateDir: stateDir,
+		live:     map[string]struct{}{},
+	}
+
+	// A machine from a runner that is gone, with Qemu still
+	// running
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	stale := newMachineRecord("aaaaaaaaaaaaaaaa", 12)
+	stale.OwnerStarted++
+	stale.PID = cmd.Process.Pid
+	stale.PIDStarted, _ = processStartTime(cmd.Process.Pid)
+	staleImage := filepath.Join(tempDir, "drone-qemu-aaaaaaaaaaaaaaaa.qcow2")
+	os.WriteFile(staleImage, nil, 0600)
+	stale.Files = []string{staleImage}
+	if err := stale.write(stateDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A machine of ours that is running
+	d.setLive("bbbbbbbbbbbbbbbb", true)
+	live := newMachineRecord("bbbbbbbbbbbbbbbb", 13)
+	liveImage := filepath.Join(tempDir, "drone-qemu-bbbbbbbbbbbbbbbb.qcow2")
+	os.WriteFile(liveImage, nil, 0600)
+	live.Files = []string{liveImage}
+	if err := live.write(stateDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A machine of ours that we lost track of
+	lost := newMachineRecord("cccccccccccccccc", 14)
+	lostImage := filepath.Join(tempDir, "drone-qemu-cccccccccccccccc.qcow2")
+	os.WriteFile(lostImage, nil, 0600)
+	lost.Files = []string{lostImage}
+	if err := lost.write(stateDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files without a record, old and new
+	orphan := filepath.Join(tempDir, "drone-qemu-dddddddddddddddd.qcow2")
+	os.WriteFile(orphan, nil, 0600)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(orphan, old, old)
+	recent := filepath.Join(tempDir, "drone-qemu-eeeeeeeeeeeeeeee.qcow2")
+	os.WriteFile(recent, nil, 0600)
+
+	// Overlays of older versions, old and new
+	legacy := filepath.Join(tempDir, "drone-qemu-5577006791947779410.qcow2")
+	os.WriteFile(legacy, nil, 0600)
+	os.Chtimes(legacy, old, old)
+	recentLegacy := filepath.Join(tempDir, "drone-qemu-8674665223082153551.qcow2")
+	os.WriteFile(recentLegacy, nil, 0600)
+
+	if err := d.cleanup(nocontext); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Errorf("Stale process was not killed")
+	}
+	for _, filename := range []string{
+		staleImage,
+		recordPath(stateDir, "aaaaaaaaaaaaaaaa"),
+		lostImage,
+		recordPath(stateDir, "cccccccccccccccc"),
+		orphan,
+		legacy,
+	} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", filename)
+		}
+	}
+	for _, filename := range []string{
+		liveImage,
+		recordPath(stateDir, "bbbbbbbbbbbbbbbb"),
+		recent,
+		recentLegacy,
+	} {
+		if _, err := os.Stat(filename); err != nil {
+			t.Errorf("%s was deleted", filename)
+		}
+	}
+}
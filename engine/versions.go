@@ -0,0 +1,294 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Subdirectory of the image directory holding the versions of the
+// images, named after their checksum. They are never modified, the
+// .qemu.json file of an image points to its current version.
+const VERSIONS_DIR = "versions"
+
+// versionFile returns the path of a version, relative to the image
+// directory.
+func versionFile(checksum string, format string) string {
+	if format == "qcow2" {
+		return path.Join(VERSIONS_DIR, checksum+".qcow2")
+	}
+	return path.Join(VERSIONS_DIR, checksum+".img")
+}
+
+// storeVersion moves a complete image file into the version store,
+// and returns its path relative to the image directory. If that
+// version is already stored, the file is deleted instead.
+func storeVersion(imageDir string, filename string, checksum string, format string) (string, error) {
+	if err := os.MkdirAll(path.Join(imageDir, VERSIONS_DIR), 0755); err != nil {
+		return "", err
+	}
+	version := versionFile(checksum, format)
+	target := path.Join(imageDir, version)
+	if _, err := os.Stat(target); err == nil {
+		os.Remove(filename)
+		// Don't let it be collected before it is pointed to
+		now := time.Now()
+		return version, os.Chtimes(target, now, now)
+	}
+	if err := os.Chmod(filename, 0444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filename, target); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// writeImageConfig atomically points an image to a new version, by
+// replacing its .qemu.json file.
+func writeImageConfig(imageDir string, name string, config MachineConfig) error {
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	return writeFileAtomic(path.Join(imageDir, name+".qemu.json"), data, 0644)
+}
+
+// loadConfig loads the configuration of an image, resolving it to
+// its current version. That version is kept until unpin is called,
+// even if the image gets updated in the meantime.
+func (d *qemuDriver) loadConfig(name string) (MachineConfig, func(), error) {
+	d.versionsMu.Lock()
+	defer d.versionsMu.Unlock()
+	config, err := loadMachineConfig(d.imageDir, name)
+	if err == nil && !d.inVersionStore(config.BaseImage) {
+		// Placed by hand, use a copy that can't change under the
+		// machine. It is recent enough not to be collected before
+		// it is pinned
+		d.versionsMu.Unlock()
+		config.BaseImage, err = d.copyVersion(config.BaseImage, config.BaseImageFormat)
+		d.versionsMu.Lock()
+		if err != nil {
+			err = fmt.Errorf("couldn't copy image to the version store: %w", err)
+		}
+	}
+	if err != nil {
+		return config, nil, err
+	}
+	image := absPath(config.BaseImage)
+	d.pinned[image]++
+	unpinned := false
+	unpin := func() {
+		d.versionsMu.Lock()
+		defer d.versionsMu.Unlock()
+		if unpinned {
+			return
+		}
+		unpinned = true
+		d.pinned[image]--
+		if d.pinned[image] <= 0 {
+			delete(d.pinned, image)
+		}
+	}
+	return config, unpin, nil
+}
+
+// inVersionStore returns whether a file is a version, rather than an
+// image file placed by hand.
+func (d *qemuDriver) inVersionStore(filename string) bool {
+	store := absPath(path.Join(d.imageDir, VERSIONS_DIR))
+	return strings.HasPrefix(absPath(filename), store+string(filepath.Separator))
+}
+
+// imageCopy is the version holding a copy of an image file placed by
+// hand, valid while the file's size and modification time are the
+// same.
+type imageCopy struct {
+	size    int64
+	modTime time.Time
+	version string
+}
+
+func (c imageCopy) matches(info os.FileInfo) bool {
+	return c.size == info.Size() && c.modTime.Equal(info.ModTime())
+}
+
+// copyVersion copies an image file that is not in the version store
+// into it, and returns the path of that version. The file is only
+// copied again once it changes.
+func (d *qemuDriver) copyVersion(filename string, format string) (string, error) {
+	d.copyMu.Lock()
+	defer d.copyMu.Unlock()
+	filename = absPath(filename)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+
+	d.versionsMu.Lock()
+	copied, ok := d.copies[filename]
+	d.versionsMu.Unlock()
+	if ok && copied.matches(info) {
+		version := path.Join(d.imageDir, copied.version)
+		// Don't let it be collected before it is pinned
+		now := time.Now()
+		if err := os.Chtimes(version, now, now); err == nil {
+			return version, nil
+		}
+	}
+
+	logrus.WithField("file", filename).Info("copying image to the version store")
+	dir := path.Join(d.imageDir, VERSIONS_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	source, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	temp, err := os.CreateTemp(dir, ".copy-")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(temp, hash), source)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	after, err := os.Stat(filename)
+	if err != nil || !(imageCopy{size: info.Size(), modTime: info.ModTime()}).matches(after) {
+		os.Remove(temp.Name())
+		return "", fmt.Errorf("%s changed while it was copied", filename)
+	}
+
+	version, err := storeVersion(d.imageDir, temp.Name(), hex.EncodeToString(hash.Sum(nil)), format)
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	d.versionsMu.Lock()
+	if d.copies == nil {
+		d.copies = map[string]imageCopy{}
+	}
+	d.copies[filename] = imageCopy{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		version: version,
+	}
+	d.versionsMu.Unlock()
+	return path.Join(d.imageDir, version), nil
+}
+
+func absPath(filename string) string {
+	absolute, err := filepath.Abs(filename)
+	if err != nil {
+		return path.Clean(filename)
+	}
+	return absolute
+}
+
+// collectVersions deletes the versions of images that are no longer
+// current and that no machine uses.
+func (d *qemuDriver) collectVersions(ctx context.Context) error {
+	d.versionsMu.Lock()
+	defer d.versionsMu.Unlock()
+
+	entries, err := os.ReadDir(path.Join(d.imageDir, VERSIONS_DIR))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Versions that images point to
+	used := map[string]bool{}
+	for image := range d.pinned {
+		used[image] = true
+	}
+	names, err := ListImages(d.imageDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// Don't go through loadMachineConfig, a broken image
+		// still holds on to its version
+		data, err := os.ReadFile(path.Join(d.imageDir, name+".qemu.json"))
+		if err != nil {
+			return err
+		}
+		var config MachineConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("invalid machine config JSON for %s: %w", name, err)
+		}
+		if config.BaseImage != "" {
+			used[absPath(resolvePath(d.imageDir, config.BaseImage))] = true
+		}
+	}
+
+	// Copies of the image files placed by hand, while they are the
+	// same
+	for filename, copied := range d.copies {
+		if info, err := os.Stat(filename); err == nil && copied.matches(info) {
+			used[absPath(path.Join(d.imageDir, copied.version))] = true
+		}
+	}
+
+	// Versions used by machines, including those of other runners
+	// sharing the state directory
+	records, err := os.ReadDir(d.stateDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range records {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		record, err := readRecord(path.Join(d.stateDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if record.BaseImage != "" {
+			used[absPath(record.BaseImage)] = true
+		}
+	}
+
+	for _, entry := range entries {
+		// Skip partial downloads and exports
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		filename := path.Join(d.imageDir, VERSIONS_DIR, entry.Name())
+		if used[absPath(filename)] {
+			continue
+		}
+		// It might be about to become current
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ORPHAN_MIN_AGE {
+			continue
+		}
+		if err := os.Remove(filename); err == nil {
+			logrus.WithField("file", filename).Info("deleted unused image version")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 Drone.IO Inc. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectVersions(t *testing.T) {
+	imageDir := t.TempDir()
+	stateDir := t.TempDir()
+	d := &qemuDriver{
+		imageDir: imageDir,
+		stateDir: stateDir,
+		pinned:   map[string]int{},
+	}
+	versions := filepath.Join(imageDir, "versions")
+	os.Mkdir(versions, 0755)
+	old := time.Now().Add(-time.Hour)
+	addVersion := func(checksum string) string {
+		filename := filepath.Join(versions, checksum+".qcow2")
+		os.WriteFile(filename, []byte(checksum), 0444)
+		os.Chtimes(filename, old, old)
+		return filename
+	}
+	pointTo := func(name string, checksum string) {
+		err := writeImageConfig(imageDir, name, MachineConfig{
+			BaseImage:       versionFile(checksum, "qcow2"),
+			BaseImageFormat: "qcow2",
+			SHA256:          checksum,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v1 := addVersion(strings.Repeat("1", 64))
+	v2 := addVersion(strings.Repeat("2", 64))
+	v3 := addVersion(strings.Repeat("3", 64))
+	v4 := addVersion(strings.Repeat("4", 64))
+	pointTo("test", strings.Repeat("1", 64))
+
+	// A build starts on the first version
+	config, unpin, err := d.loadConfig("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != v1 {
+		t.Fatalf("Unexpected base image %q", config.BaseImage)
+	}
+
+	// The image is updated while it runs
+	pointTo("test", strings.Repeat("2", 64))
+
+	// A machine of another runner uses the third version
+	record := newMachineRecord("aaaaaaaaaaaaaaaa", 12)
+	record.BaseImage = v3
+	record.write(stateDir)
+
+	// A new version that is not pointed to yet
+	v5 := addVersion(strings.Repeat("5", 64))
+	os.Chtimes(v5, time.Now(), time.Now())
+
+	if err := d.collectVersions(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{v1, v2, v3, v5} {
+		if _, err := os.Stat(filename); err != nil {
+			t.Errorf("Version %s was deleted", filepath.Base(filename))
+		}
+	}
+	if _, err := os.Stat(v4); !os.IsNotExist(err) {
+		t.Errorf("Unused version was not deleted")
+	}
+
+	// Once the build is done, its version can go
+	unpin()
+	unpin()
+	if len(d.pinned) != 0 {
+		t.Errorf("Expected no pinned versions, got %v", d.pinned)
+	}
+	if err := d.collectVersions(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(v1); !os.IsNotExist(err) {
+		t.Errorf("Previous version was not deleted")
+	}
+	if _, err := os.Stat(v2); err != nil {
+		t.Errorf("Current version was deleted")
+	}
+}
+
+func TestStoreVersion(t *testing.T) {
+	imageDir := t.TempDir()
+	checksum := strings.Repeat("a", 64)
+	for i := 0; i < 2; i++ {
+		filename := filepath.Join(imageDir, "new.qcow2")
+		os.WriteFile(filename, []byte("image"), 0644)
+		version, err := storeVersion(imageDir, filename, checksum, "qcow2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != "versions/"+checksum+".qcow2" {
+			t.Errorf("Unexpected version %q", version)
+		}
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("File was left behind")
+		}
+		info, err := os.Stat(filepath.Join(imageDir, version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0222 != 0 {
+			t.Errorf("Version is writable")
+		}
+	}
+}
+
+func TestLoadConfig_HandPlaced(t *testing.T) {
+	imageDir := t.TempDir()
+	d := &qemuDriver{
+		imageDir: imageDir,
+		stateDir: t.TempDir(),
+		pinned:   map[string]int{},
+	}
+	filename := filepath.Join(imageDir, "test.qcow2")
+	os.WriteFile(filename, []byte("first"), 0644)
+	os.WriteFile(filepath.Join(imageDir, "test.qemu.json"), []byte(`{}`), 0644)
+
+	// The machine uses a copy, not the file placed by hand
+	config, unpin, err := d.loadConfig("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := config.BaseImage
+	if !d.inVersionStore(first) {
+		t.Fatalf("Image was not copied to the version store: %q", first)
+	}
+	if data, _ := os.ReadFile(first); string(data) != "first" {
+		t.Errorf("Unexpected copy content %q", data)
+	}
+
+	// It is copied only once, and kept while the file is the same
+	config, unpin2, err := d.loadConfig("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseImage != first {
+		t.Errorf("Image was copied again to %q", config.BaseImage)
+	}
+	unpin()
+	unpin2()
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(first, old, old)
+	if err := d.collectVersions(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatal("Copy of the current file was deleted")
+	}
+
+	// The file is replaced in place, the copy is unchanged
+	os.WriteFile(filename, []byte("second"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filename, future, future)
+	config, unpin, err = d.loadConfig("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unpin()
+	if config.BaseImage == first {
+		t.Fatal("Changed image was not copied again")
+	}
+	if data, _ := os.ReadFile(first); string(data) != "first" {
+		t.Errorf("Previous copy was modified: %q", data)
+	}
+	if data, _ := os.ReadFile(config.BaseImage); string(data) != "second" {
+		t.Errorf("Unexpected copy content %q", data)
+	}
+
+	// The previous copy is no longer used
+	if err := d.collectVersions(nocontext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("Previous copy was not deleted")
+	}
+}
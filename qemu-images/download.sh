@@ -20,6 +20,10 @@ if ! [ -e "debian-12.qcow2" ]; then
     curl -SLo "debian-12.qcow2" https://cloud.debian.org/images/cloud/bookworm/latest/debian-12-genericcloud-amd64.qcow2
 fi
 
+if ! [ -e "debian-12-arm64.qcow2" ]; then
+    curl -SLo "debian-12-arm64.qcow2" https://cloud.debian.org/images/cloud/bookworm/latest/debian-12-genericcloud-arm64.qcow2
+fi
+
 if ! [ -e "fedora-40.qcow2" ]; then
     curl -SLo "fedora-40.qcow2" https://download.fedoraproject.org/pub/fedora/linux/releases/40/Cloud/x86_64/images/Fedora-Cloud-Base-Generic.x86_64-40-1.14.qcow2
 fi